@@ -0,0 +1,382 @@
+package bridge
+
+import (
+	"akwatek-mqtt-bridge/homie"
+	"akwatek-mqtt-bridge/models"
+	"akwatek-mqtt-bridge/notify"
+	"akwatek-mqtt-bridge/passthrough"
+	"akwatek-mqtt-bridge/policy"
+	"akwatek-mqtt-bridge/scheduler"
+	"akwatek-mqtt-bridge/sink"
+	"akwatek-mqtt-bridge/store"
+	"akwatek-mqtt-bridge/utils"
+	"encoding/json"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Bridge decode the controllers check-ins, answer them and publish their state
+type Bridge struct {
+	config    *utils.Config
+	cli       sink.Publisher
+	registry  *models.Registry
+	store     store.Store
+	upstream  *passthrough.Client
+	policy    *policy.Engine
+	scheduler *scheduler.Scheduler
+	homie     *homie.Homie
+	sinks     []sink.Sink
+	commands  []sink.CommandSource
+	notifier  *notify.Notifier
+	capture   *Capture
+	wg        sync.WaitGroup
+}
+
+func NewBridge(config *utils.Config, cli sink.Publisher, registryStore store.Store) *Bridge {
+	return &Bridge{
+		config:   config,
+		cli:      cli,
+		registry: models.NewRegistry(),
+		store:    registryStore,
+	}
+}
+
+// SetPassthrough relay every check-in to the upstream
+func (b *Bridge) SetPassthrough(upstream *passthrough.Client) {
+	b.upstream = upstream
+}
+
+// SetPolicy close the valve when a rule of the engine fires
+func (b *Bridge) SetPolicy(engine *policy.Engine) {
+	b.policy = engine
+}
+
+// SetScheduler run the scheduled valve actions
+func (b *Bridge) SetScheduler(s *scheduler.Scheduler) {
+	b.scheduler = s
+}
+
+// SetHomie publish the controllers as Homie devices too,
+// the last will only cover the bridge availability, so every device goes from init to ready or lost again on a re-connection
+func (b *Bridge) SetHomie(h *homie.Homie) {
+	b.homie = h
+	b.cli.OnConnect(func() {
+		b.async(func() {
+			for _, ctl := range b.registry.List() {
+				h.PublishDevice(ctl)
+			}
+		})
+	})
+}
+
+// SetSinks fan out the state of the controllers to the sinks
+func (b *Bridge) SetSinks(sinks []sink.Sink) {
+	b.sinks = sinks
+}
+
+// AddCommandSource receive the valve commands of the controllers from the source
+func (b *Bridge) AddCommandSource(source sink.CommandSource) {
+	b.commands = append(b.commands, source)
+}
+
+// SetNotifier send the events to the webhooks of the notifier
+func (b *Bridge) SetNotifier(notifier *notify.Notifier) {
+	b.notifier = notifier
+}
+
+// Close set the Homie devices disconnected and close the sinks and the notifier, on shutdown
+func (b *Bridge) Close() {
+	if b.homie != nil {
+		b.homie.Disconnect(b.registry.List())
+	}
+	for _, s := range b.sinks {
+		if err := s.Close(); err != nil {
+			log.Error().Err(err).Msgf("failed to close sink %s", s.Name())
+		}
+	}
+	if b.notifier != nil {
+		if err := b.notifier.Close(); err != nil {
+			log.Error().Err(err).Msg("failed to close the notifier")
+		}
+	}
+}
+
+// SetCapture record every check-in and its response
+func (b *Bridge) SetCapture(capture *Capture) {
+	b.capture = capture
+}
+
+// Restore load the controllers from the store and publish their last known state
+func (b *Bridge) Restore() {
+	snapshots, err := b.store.Load()
+	if err != nil {
+		log.Error().Err(err).Msg("failed to load controllers from the store")
+	}
+	for _, snapshot := range snapshots {
+		ctl, err := models.NewAkwatekCtlFromSnapshot(snapshot)
+		if err != nil {
+			log.Error().Err(err).Msgf("failed to restore controller %s", snapshot.Request.MacAddress)
+			continue
+		}
+		log.Info().Msgf("Controller restored from the store: %s", ctl)
+		b.registry.Add(ctl)
+		b.setup(ctl)
+		// don't wait for the next check-in to publish the last known state
+		if b.isStale(ctl, time.Now()) {
+			ctl.SetOffline(true)
+		}
+		b.async(func() {
+			b.PublishHassConfig(ctl)
+			if b.homie != nil {
+				b.homie.PublishDevice(ctl)
+			}
+			if ctl.IsOffline() {
+				b.PublishCtlOffline(ctl)
+				return
+			}
+			b.PublishCtlState(ctl)
+		})
+	}
+}
+
+// CheckIn handle the raw body of a /collect2.php request and return the response for the controller
+func (b *Bridge) CheckIn(rawBody []byte, header http.Header) (*models.ResBodyItekV1, error) {
+	res, err := b.checkIn(rawBody, header)
+	if b.capture != nil {
+		b.capture.Record(rawBody, res, err)
+	}
+	return res, err
+}
+
+func (b *Bridge) checkIn(rawBody []byte, header http.Header) (*models.ResBodyItekV1, error) {
+	var reqBodyItekV1 models.ReqBodyItekV1
+	if err := json.Unmarshal(rawBody, &reqBodyItekV1); err != nil {
+		return nil, err
+	}
+	itekv1 := reqBodyItekV1.ItekV1
+	// create new akwatek controller object if not present, or update values of controller
+	ctl, created, err := b.registry.CheckIn(&itekv1)
+	if err != nil {
+		return nil, err
+	}
+	if created {
+		b.setup(ctl)
+	}
+	onlineEvent := b.markOnline(ctl)
+	transitionEvents := ctl.GetTransitionEvents()
+	for _, event := range transitionEvents {
+		log.Info().Msgf("%s: %s", ctl.MAC, event.Message)
+	}
+	checkedCommand := ctl.CheckValveCommand(b.config.ValveCommand.ConfirmCheckIns, b.config.ValveCommand.MaxAttempts)
+	// queued before the valve command is taken, so they are sent in this response,
+	// the policy last so a closing for safety wins over a scheduled opening
+	scheduleCommands := b.applySchedules(ctl)
+	policyCommands, policyEvents := b.applyPolicy(ctl)
+
+	log.Debug().Msgf("%v", reqBodyItekV1.ItekV1)
+	log.Info().Msgf("%s -- %v", ctl, ctl.GetSensors())
+	var cloudRes *models.ResBodyItekV1
+	if b.upstream != nil {
+		// fallback on the local response if the upstream is down
+		if cloudRes, err = b.upstream.Relay(rawBody, header); err != nil {
+			log.Error().Err(err).Msgf("failed to relay request to %s", b.config.Passthrough.URL)
+		}
+	}
+	// take the valve command last, a command received meanwhile is sent now instead of being dropped
+	resItekV1 := models.ResItekV1{
+		Message: "OK",
+	}
+	sentCommand := ctl.TakeValveCommand()
+	if sentCommand != nil {
+		resItekV1.Valve = &sentCommand.Action
+	}
+	if cloudRes != nil {
+		resItekV1.Message = cloudRes.ItekV1.Message
+		resItekV1.Valve = b.mergeCloudValve(ctl, sentCommand, cloudRes.ItekV1.Valve)
+		// the local command isn't sent, it's not published as sent nor sent again later
+		if sentCommand != nil && (resItekV1.Valve == nil || *resItekV1.Valve != sentCommand.Action) {
+			if superseded := ctl.SupersedeSentValveCommand(sentCommand, "cloud priority, the valve action of the cloud was sent instead"); superseded != nil {
+				sentCommand = superseded
+			}
+		}
+	}
+	var dryRunEvent *models.Event
+	if ctl.IsDryRun() && resItekV1.Valve != nil {
+		dryRunEvent = b.dryRun(ctl, *resItekV1.Valve)
+		resItekV1.Valve = nil
+	}
+
+	// Async mqtt publish
+	b.async(func() {
+		// discovery configs are retained, they are published again only when Home Assistant restart
+		hassConfigPublished := false
+		if !ctl.IsHassConfigPublished() {
+			b.PublishHassConfig(ctl)
+			hassConfigPublished = true
+		}
+
+		b.PublishSensorsLifecycle(ctl, hassConfigPublished)
+		b.PublishCtlState(ctl)
+		commands := append([]*models.ValveCommand{checkedCommand}, scheduleCommands...)
+		commands = append(append(commands, policyCommands...), sentCommand)
+		for _, command := range commands {
+			if command != nil {
+				b.PublishValveResult(ctl, command)
+			}
+		}
+		events := append([]*models.Event{onlineEvent}, transitionEvents...)
+		for _, event := range append(append(events, policyEvents...), dryRunEvent) {
+			if event != nil {
+				b.PublishEvent(ctl, event)
+			}
+		}
+		b.SaveCtl(ctl)
+	})
+
+	return &models.ResBodyItekV1{
+		ItekV1: resItekV1,
+	}, nil
+}
+
+// setup apply the settings of a new controller and subscribe to its commands
+func (b *Bridge) setup(ctl *models.AkwatekCtl) {
+	ctl.SetMetadata(b.metadata(ctl))
+	if b.config.IsDryRun(ctl.MAC) {
+		log.Warn().Msgf("Dry-run enabled for %s, the valve commands are never sent", ctl.MAC)
+		ctl.SetDryRun(true)
+	}
+	for _, source := range b.commands {
+		source.WatchValve(ctl, b.valveCommandCallback(ctl))
+	}
+	if b.config.ValveCommand.Interlock == utils.VALVE_INTERLOCK_OVERRIDE {
+		b.cli.WatchCommand(ctl.GetMQTTValveOverrideTopic(b.config.MQTT.BaseTopic), b.valveOverrideCallback(ctl))
+	}
+	b.watchSchedules(ctl)
+}
+
+// metadata return the Home Assistant device information of the controller and its zones from the config
+func (b *Bridge) metadata(ctl *models.AkwatekCtl) *models.CtlMetadata {
+	metadata := &models.CtlMetadata{
+		ConfigurationURL: b.config.HassConfigurationURL,
+		SensorDevices:    b.config.HassSensorDevices,
+		Zones:            map[int]*models.ZoneMetadata{},
+	}
+	controller := b.config.GetController(ctl.MAC)
+	if controller == nil {
+		return metadata
+	}
+	metadata.Name = controller.Name
+	metadata.Area = controller.Area
+	for _, zone := range controller.Zones {
+		metadata.Zones[zone.ID] = &models.ZoneMetadata{
+			Name:   zone.Name,
+			Area:   zone.Area,
+			Ignore: zone.Ignore,
+		}
+	}
+	return metadata
+}
+
+// WatchHassStatus publish again every discovery config, availability and state when Home Assistant start
+func (b *Bridge) WatchHassStatus() {
+	b.cli.WatchHassStatus(fmt.Sprintf("%s/status", b.config.HassDiscoveryTopic), func(online bool) {
+		if !online {
+			log.Info().Msg("Home Assistant is offline")
+			return
+		}
+		log.Info().Msg("Home Assistant is online, publishing discovery and states")
+		b.async(func() {
+			for _, ctl := range b.registry.List() {
+				b.PublishHassConfig(ctl)
+				if ctl.IsOffline() {
+					b.PublishCtlOffline(ctl)
+					continue
+				}
+				b.PublishCtlState(ctl)
+			}
+		})
+	})
+}
+
+func (b *Bridge) async(f func()) {
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		f()
+	}()
+}
+
+// Wait for the async publications to be done
+func (b *Bridge) Wait() {
+	b.wg.Wait()
+}
+
+func (b *Bridge) SaveCtl(ctl *models.AkwatekCtl) {
+	if err := b.store.Save(ctl.GetIdentifier(), ctl.Snapshot()); err != nil {
+		log.Error().Err(err).Msgf("failed to save controller %s", ctl.MAC)
+	}
+}
+
+func (b *Bridge) PublishCtlState(ctl *models.AkwatekCtl) {
+	b.publishSinks(ctl)
+	b.PublishDiagnostics(ctl)
+	b.PublishSchedulesState(ctl)
+	if b.homie != nil {
+		b.homie.PublishState(ctl)
+	}
+}
+
+// publishSinks give the state of the controller to every sink, a failing sink doesn't stop the others
+func (b *Bridge) publishSinks(ctl *models.AkwatekCtl) {
+	record := sink.NewRecord(ctl)
+	for _, s := range b.sinks {
+		if err := s.Publish(record); err != nil {
+			log.Error().Err(err).Msgf("failed to publish %s to sink %s", ctl.MAC, s.Name())
+		}
+	}
+}
+
+func (b *Bridge) PublishDiagnostics(ctl *models.AkwatekCtl) {
+	b.cli.PublishDiagnostics(ctl.GetMQTTDiagnosticsTopic(b.config.MQTT.BaseTopic), ctl.GetDiagnostics(), ctl.GetMQTTUserProperties())
+}
+
+// PublishSensorsLifecycle publish the discovery of the newly paired sensors
+// and clear the discovery of the removed ones after the grace period
+func (b *Bridge) PublishSensorsLifecycle(ctl *models.AkwatekCtl, hassConfigPublished bool) {
+	paired := false
+	expired := make([]*models.LeakoSensor, 0)
+	for _, sensor := range ctl.GetSensors() {
+		switch {
+		case sensor.JustPaired:
+			log.Info().Msgf("Sensor %d paired on controller %s", sensor.ID, ctl.MAC)
+			b.PublishEvent(ctl, models.NewSensorEvent(sensor, models.EVENT_SENSOR_PAIRED, fmt.Sprintf("sensor %d paired", sensor.ID)))
+			paired = true
+			if !hassConfigPublished && b.config.HassDiscoveryEnabled && b.config.HassDiscoveryMode == utils.HASS_DISCOVERY_ENTITY {
+				b.PublishSensorHassConfig(sensor)
+			}
+		case sensor.JustRemoved:
+			log.Info().Msgf("Sensor %d removed from controller %s", sensor.ID, ctl.MAC)
+			b.PublishEvent(ctl, models.NewSensorEvent(sensor, models.EVENT_SENSOR_REMOVED, fmt.Sprintf("sensor %d removed", sensor.ID)))
+		}
+		if sensor.IsRemoved() && sensor.RemovedAt.Add(b.config.SensorRemovalGrace).Before(time.Now()) {
+			log.Info().Msgf("Clearing discovery of sensor %d removed from controller %s", sensor.ID, ctl.MAC)
+			if b.config.HassDiscoveryMode == utils.HASS_DISCOVERY_ENTITY {
+				for _, topic := range sensor.GetMQTTHassConfigTopics(b.config.HassDiscoveryTopic) {
+					b.cli.ClearRetained(topic)
+				}
+			}
+			b.clearSensorState(sensor)
+			expired = append(expired, sensor)
+		}
+	}
+	// the device discovery has every entity of the device, it's published again for a sensor added or removed
+	if b.config.HassDiscoveryEnabled && b.config.HassDiscoveryMode == utils.HASS_DISCOVERY_DEVICE && ((paired && !hassConfigPublished) || len(expired) > 0) {
+		b.publishHassDevices(ctl, expired)
+	}
+	for _, sensor := range expired {
+		ctl.ForgetSensor(sensor.ID)
+	}
+}
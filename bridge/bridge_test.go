@@ -0,0 +1,381 @@
+package bridge
+
+import (
+	"akwatek-mqtt-bridge/models"
+	"akwatek-mqtt-bridge/sink"
+	"akwatek-mqtt-bridge/store"
+	"akwatek-mqtt-bridge/utils"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const mac = "bc:ff:4d:00:00:01"
+
+// fakePublisher record the topics published, in order in sequence, and the callbacks of the watched ones
+type fakePublisher struct {
+	mu        sync.Mutex
+	published map[string][]string
+	sequence  []string
+	commands  map[string]func(payload []byte) json.Marshaler
+}
+
+func newFakePublisher() *fakePublisher {
+	return &fakePublisher{
+		published: map[string][]string{},
+		commands:  map[string]func(payload []byte) json.Marshaler{},
+	}
+}
+
+func (p *fakePublisher) publish(topic string, payload json.Marshaler) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		panic(err)
+	}
+	p.record(topic, string(data))
+}
+
+// record a publication, mu must not be held
+func (p *fakePublisher) record(topic string, payload string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.published[topic] = append(p.published[topic], payload)
+	p.sequence = append(p.sequence, topic)
+}
+
+// index return the position of the first publication of the topic with the payload, -1 if none
+func (p *fakePublisher) index(topic string, payload string) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	count := 0
+	for i, published := range p.sequence {
+		if published != topic {
+			continue
+		}
+		if p.published[topic][count] == payload {
+			return i
+		}
+		count++
+	}
+	return -1
+}
+
+// last return the last payload published on the topic, "" for a cleared one
+func (p *fakePublisher) last(topic string) (string, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	published := p.published[topic]
+	if len(published) == 0 {
+		return "", false
+	}
+	return published[len(published)-1], true
+}
+
+// get return the payloads published on the topics ending with suffix
+func (p *fakePublisher) get(suffix string) []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	payloads := make([]string, 0)
+	for topic, published := range p.published {
+		if strings.HasSuffix(topic, suffix) {
+			payloads = append(payloads, published...)
+		}
+	}
+	return payloads
+}
+
+func (p *fakePublisher) PublishDiscovery(topic string, payload json.Marshaler) {
+	p.publish(topic, payload)
+}
+
+func (p *fakePublisher) PublishDiagnostics(topic string, payload json.Marshaler, _ map[string]string) {
+	p.publish(topic, payload)
+}
+
+func (p *fakePublisher) PublishEvent(topic string, payload json.Marshaler, _ map[string]string) {
+	p.publish(topic, payload)
+}
+
+func (p *fakePublisher) PublishValveResult(topic string, payload json.Marshaler, _ map[string]string) {
+	p.publish(topic, payload)
+}
+
+func (p *fakePublisher) PublishValveHistory(topic string, payload json.Marshaler) {
+	p.publish(topic, payload)
+}
+
+func (p *fakePublisher) PublishValveOverride(topic string, payload json.Marshaler, _ map[string]string) {
+	p.publish(topic, payload)
+}
+
+func (p *fakePublisher) PublishValveError(topic string, payload json.Marshaler, _ map[string]string) {
+	p.publish(topic, payload)
+}
+
+func (p *fakePublisher) PublishSwitchState(topicID string, on bool) {
+	p.record(topicID, fmt.Sprint(on))
+}
+
+func (p *fakePublisher) ClearRetained(topic string) {
+	p.record(topic, "")
+}
+
+func (p *fakePublisher) WatchCommand(topicID string, callback func(payload []byte) json.Marshaler) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.commands[topicID] = callback
+}
+
+func (p *fakePublisher) WatchSwitch(string, func(on bool)) {}
+
+func (p *fakePublisher) WatchHassStatus(string, func(online bool)) {}
+
+func (p *fakePublisher) OnConnect(func()) {}
+
+// fakeSink record the states, as records and as JSON when published, and give the valve commands of the test to the bridge
+type fakeSink struct {
+	mu       sync.Mutex
+	records  []*sink.Record
+	states   []string
+	callback func(payload []byte) json.Marshaler
+}
+
+func (s *fakeSink) Name() string {
+	return "fake"
+}
+
+func (s *fakeSink) Publish(record *sink.Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records = append(s.records, record)
+	state, err := json.Marshal(&struct {
+		Controller *models.AkwatekCtl    `json:"controller"`
+		Sensors    []*models.LeakoSensor `json:"sensors"`
+		Offline    bool                  `json:"offline"`
+	}{record.Controller, record.Sensors, record.Offline})
+	if err != nil {
+		return err
+	}
+	s.states = append(s.states, string(state))
+	return nil
+}
+
+func (s *fakeSink) Close() error {
+	return nil
+}
+
+func (s *fakeSink) WatchValve(_ *models.AkwatekCtl, callback func(payload []byte) json.Marshaler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.callback = callback
+}
+
+func (s *fakeSink) command(payload string) json.Marshaler {
+	s.mu.Lock()
+	callback := s.callback
+	s.mu.Unlock()
+	return callback([]byte(payload))
+}
+
+func newBridge() (*Bridge, *fakePublisher, *fakeSink) {
+	config := &utils.Config{
+		MQTT: &utils.ConfigMQTT{BaseTopic: "akwatek"},
+		ValveCommand: &utils.ConfigValveCommand{
+			ConfirmCheckIns: 2,
+			MaxAttempts:     3,
+			Interlock:       utils.VALVE_INTERLOCK_REJECT,
+		},
+		CheckInInterval:       time.Minute,
+		OfflineMissedCheckIns: 3,
+		SensorRemovalGrace:    time.Hour,
+	}
+	publisher := newFakePublisher()
+	fake := &fakeSink{}
+	b := NewBridge(config, publisher, &store.NoopStore{})
+	b.SetSinks([]sink.Sink{fake})
+	b.AddCommandSource(fake)
+	return b, publisher, fake
+}
+
+// checkIn send a check-in of the controller and return the valve action of the response, once published
+func checkIn(t *testing.T, b *Bridge, status string, zones string) string {
+	t.Helper()
+	body := fmt.Sprintf(`{"Itek_V1":{"MAC_address":%q,"ID":"1.0","Cont_status":%q,"zone01-25":%q}}`, mac, status, zones)
+	res, err := b.CheckIn([]byte(body), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Wait()
+	if res.ItekV1.Message != "OK" {
+		t.Errorf("got message %q, expected OK", res.ItekV1.Message)
+	}
+	if res.ItekV1.Valve == nil {
+		return ""
+	}
+	return res.ItekV1.Valve.String()
+}
+
+// statuses return the status of the valve command results
+func statuses(t *testing.T, publisher *fakePublisher) []string {
+	t.Helper()
+	statuses := make([]string, 0)
+	for _, payload := range publisher.get("/valve/result") {
+		var command models.ValveCommand
+		if err := json.Unmarshal([]byte(payload), &command); err != nil {
+			t.Fatal(err)
+		}
+		statuses = append(statuses, command.Status)
+	}
+	return statuses
+}
+
+// events return the type of the events published, with the zone for a sensor event, in order
+func events(t *testing.T, publisher *fakePublisher, types ...string) []string {
+	t.Helper()
+	events := make([]string, 0)
+	for _, payload := range publisher.get("/event") {
+		var event models.Event
+		if err := json.Unmarshal([]byte(payload), &event); err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Contains(types, event.Type) {
+			continue
+		}
+		if event.Sensor != 0 {
+			events = append(events, fmt.Sprintf("%s %d", event.Type, event.Sensor))
+			continue
+		}
+		events = append(events, event.Type)
+	}
+	return events
+}
+
+func TestCheckInPublishToSinks(t *testing.T) {
+	b, publisher, fake := newBridge()
+	if valve := checkIn(t, b, "18041", "111"); valve != "" {
+		t.Errorf("got valve action %s, expected none", valve)
+	}
+	checkIn(t, b, "18041", "191")
+
+	if len(fake.records) != 2 {
+		t.Fatalf("got %d records, expected 2", len(fake.records))
+	}
+	record := fake.records[1]
+	if record.Controller.MAC.String() != mac || record.Offline || len(record.Sensors) != 3 {
+		t.Errorf("unexpected record %+v", record)
+	}
+	if !record.Sensors[1].IsWaterDetected() {
+		t.Errorf("leak of zone 2 not in the record")
+	}
+	if diagnostics := publisher.get("/diagnostics"); len(diagnostics) != 2 {
+		t.Errorf("got %d diagnostics, expected 2", len(diagnostics))
+	}
+	events := strings.Join(publisher.get("/event"), "\n")
+	if !strings.Contains(events, models.EVENT_LEAK_STARTED) {
+		t.Errorf("no %s event in %s", models.EVENT_LEAK_STARTED, events)
+	}
+}
+
+func TestCheckInValveCommand(t *testing.T) {
+	b, publisher, fake := newBridge()
+	checkIn(t, b, "18041", "111")
+
+	fake.command("CLOSE")
+	if valve := checkIn(t, b, "18041", "111"); valve != "CLOSE" {
+		t.Errorf("got valve action %q, expected CLOSE", valve)
+	}
+	// sent once, confirmed by the valve bit
+	if valve := checkIn(t, b, "18040", "111"); valve != "" {
+		t.Errorf("got valve action %q, expected none", valve)
+	}
+	expected := []string{models.VALVE_COMMAND_PENDING, models.VALVE_COMMAND_SENT, models.VALVE_COMMAND_CONFIRMED}
+	if got := statuses(t, publisher); !slices.Equal(got, expected) {
+		t.Errorf("got results %v, expected %v", got, expected)
+	}
+	if history := publisher.get("/valve/history"); len(history) != 1 {
+		t.Errorf("got %d histories, expected 1", len(history))
+	}
+}
+
+func TestCheckInInterlock(t *testing.T) {
+	b, publisher, fake := newBridge()
+	checkIn(t, b, "18040", "191")
+
+	if _, ok := fake.command("OPEN").(*models.ValveCommandRejection); !ok {
+		t.Errorf("opening during a leak not refused")
+	}
+	if valve := checkIn(t, b, "18040", "191"); valve != "" {
+		t.Errorf("got valve action %q, expected none", valve)
+	}
+	if errors := publisher.get("/valve/error"); len(errors) != 1 {
+		t.Errorf("got %d valve errors, expected 1", len(errors))
+	}
+	if got := statuses(t, publisher); len(got) != 0 {
+		t.Errorf("got results %v, expected none", got)
+	}
+}
+
+func TestSensorLifecycle(t *testing.T) {
+	b, publisher, _ := newBridge()
+	b.config.HassDiscoveryEnabled = true
+	b.config.HassDiscoveryTopic = "homeassistant"
+	b.config.HassDiscoveryMode = utils.HASS_DISCOVERY_ENTITY
+	b.config.SensorRemovalGrace = 50 * time.Millisecond
+	// the zones of the first check-in are already paired, no event
+	checkIn(t, b, "18041", "11")
+	ctl := b.registry.List()[0]
+	topic := func(id int) string {
+		return fmt.Sprintf("homeassistant/binary_sensor/%s/sensor-%d-leak/config", ctl.GetMQTTHassNodeId(), id)
+	}
+	sensorEvents := func() []string {
+		return events(t, publisher, models.EVENT_SENSOR_PAIRED, models.EVENT_SENSOR_REMOVED)
+	}
+
+	// a new zone is paired, its discovery is published
+	checkIn(t, b, "18041", "111")
+	if got := sensorEvents(); !slices.Contains(got, "sensor_paired 3") {
+		t.Errorf("got events %v, expected sensor 3 paired", got)
+	}
+	if config, _ := publisher.last(topic(3)); config == "" {
+		t.Errorf("discovery of sensor 3 not published")
+	}
+
+	// a zone unpaired within the grace period is kept, and is paired again when it's back
+	checkIn(t, b, "18041", "101")
+	checkIn(t, b, "18041", "101")
+	if sensors := ctl.GetSensors(); len(sensors) != 3 || !sensors[1].IsRemoved() || sensors[1].JustRemoved {
+		t.Errorf("unexpected sensors %v within the grace period", sensors)
+	}
+	if config, _ := publisher.last(topic(2)); config == "" {
+		t.Errorf("discovery of sensor 2 cleared within the grace period")
+	}
+	checkIn(t, b, "18041", "111")
+	expected := []string{"sensor_paired 3", "sensor_removed 2", "sensor_paired 2"}
+	if got := sensorEvents(); !slices.Equal(got, expected) {
+		t.Errorf("got events %v, expected %v", got, expected)
+	}
+
+	// a zone unpaired for longer than the grace period is cleared and forgotten
+	checkIn(t, b, "18041", "101")
+	time.Sleep(2 * b.config.SensorRemovalGrace)
+	checkIn(t, b, "18041", "101")
+	if sensors := ctl.GetSensors(); len(sensors) != 2 {
+		t.Errorf("got sensors %v, expected sensor 2 forgotten", sensors)
+	}
+	for _, topic := range []string{topic(2), "akwatek/" + ctl.GetIdentifier() + "/sensors/2/state"} {
+		if payload, ok := publisher.last(topic); !ok || payload != "" {
+			t.Errorf("%s not cleared", topic)
+		}
+	}
+	if config, _ := publisher.last(topic(3)); config == "" {
+		t.Errorf("discovery of sensor 3 cleared")
+	}
+	expected = append(expected, "sensor_removed 2")
+	if got := sensorEvents(); !slices.Equal(got, expected) {
+		t.Errorf("got events %v, expected %v", got, expected)
+	}
+}
@@ -0,0 +1,66 @@
+package bridge
+
+import (
+	"akwatek-mqtt-bridge/models"
+	"encoding/json"
+	"github.com/rs/zerolog/log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// CaptureRecord is a line of the capture file
+type CaptureRecord struct {
+	Time     time.Time       `json:"time"`
+	Request  json.RawMessage `json:"request"`
+	Status   int             `json:"status"`
+	Response json.RawMessage `json:"response"`
+}
+
+// Capture append every check-in to a JSONL file
+type Capture struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+func NewCapture(path string) (*Capture, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o640)
+	if err != nil {
+		return nil, err
+	}
+	return &Capture{file: file}, nil
+}
+
+func (c *Capture) Record(rawBody []byte, res *models.ResBodyItekV1, resErr error) {
+	record := CaptureRecord{
+		Time:     time.Now(),
+		Request:  rawBody,
+		Status:   http.StatusOK,
+		Response: []byte("{}"),
+	}
+	// keep the file valid JSONL even if the controller sent garbage
+	if !json.Valid(rawBody) {
+		record.Request, _ = json.Marshal(string(rawBody))
+	}
+	if resErr != nil {
+		record.Status = http.StatusBadRequest
+	} else if response, err := json.Marshal(res); err == nil {
+		record.Response = response
+	}
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to marshall capture record")
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, err := c.file.Write(append(line, '\n')); err != nil {
+		log.Error().Err(err).Msgf("failed to write capture to %s", c.file.Name())
+	}
+}
+
+func (c *Capture) Close() error {
+	return c.file.Close()
+}
@@ -0,0 +1,147 @@
+package bridge
+
+import (
+	"akwatek-mqtt-bridge/models"
+	"akwatek-mqtt-bridge/utils"
+	"github.com/rs/zerolog/log"
+	"slices"
+	"time"
+)
+
+// PublishHassConfig publish the discovery of the controller and its sensors,
+// one message per entity or one per device depending on AMB_HASS_DISCOVERY_MODE, nothing if AMB_HASS_DISCOVERY is disabled
+func (b *Bridge) PublishHassConfig(ctl *models.AkwatekCtl) {
+	if !b.config.HassDiscoveryEnabled {
+		ctl.SetLastHassConfigPublished(time.Now())
+		return
+	}
+	log.Info().Msgf("Publishing homeassistant mqtt config")
+	if b.config.HassDiscoveryMode == utils.HASS_DISCOVERY_DEVICE {
+		b.publishHassDevices(ctl, nil)
+	} else {
+		b.publishHassEntities(ctl)
+	}
+	ctl.SetLastHassConfigPublished(time.Now())
+}
+
+// hassEntities return the entities of the controller, the schedules ones included
+func (b *Bridge) hassEntities(ctl *models.AkwatekCtl) []*models.HassEntity {
+	return append(ctl.GetMQTTHassEntities(b.config.MQTT.BaseTopic), b.scheduleHassEntities(ctl)...)
+}
+
+// publishHassEntities publish the discovery of every entity on its own topic,
+// with AMB_HASS_DISCOVERY_MIGRATE the device discovery topics are migrated then cleared
+func (b *Bridge) publishHassEntities(ctl *models.AkwatekCtl) {
+	deviceTopics := []string{ctl.GetMQTTHassDeviceConfigTopic(b.config.HassDiscoveryTopic)}
+	for _, sensor := range ctl.GetSensors() {
+		if sensor.HasOwnDevice() {
+			deviceTopics = append(deviceTopics, sensor.GetMQTTHassDeviceConfigTopic(b.config.HassDiscoveryTopic))
+		}
+	}
+	b.migrateHassDiscovery(deviceTopics)
+
+	for _, entity := range b.hassEntities(ctl) {
+		b.cli.PublishDiscovery(entity.GetTopic(b.config.HassDiscoveryTopic, ctl.GetMQTTHassNodeId()), entity.Config)
+	}
+	for _, sensor := range ctl.GetSensors() {
+		if !sensor.IsConfigured() || sensor.IsRemoved() {
+			continue
+		}
+		b.PublishSensorHassConfig(sensor)
+	}
+	b.clearMigratedHassDiscovery(deviceTopics)
+}
+
+// PublishSensorHassConfig publish the discovery of every entity of a sensor, or clear it if its zone is ignored
+func (b *Bridge) PublishSensorHassConfig(sensor *models.LeakoSensor) {
+	for _, entity := range sensor.GetMQTTHassEntities(b.config.MQTT.BaseTopic) {
+		topic := entity.GetTopic(b.config.HassDiscoveryTopic, sensor.Ctl.GetMQTTHassNodeId())
+		if sensor.IsIgnored() {
+			b.cli.ClearRetained(topic)
+			continue
+		}
+		b.cli.PublishDiscovery(topic, entity.Config)
+	}
+	if sensor.IsIgnored() {
+		b.clearSensorState(sensor)
+	}
+}
+
+// publishHassDevices publish a single discovery for the controller with its entities and the sensors in its device,
+// and one for each sensor with its own device. The ignored and expired sensors are removed,
+// with AMB_HASS_DISCOVERY_MIGRATE the entity discovery topics are migrated then cleared
+func (b *Bridge) publishHassDevices(ctl *models.AkwatekCtl, expired []*models.LeakoSensor) {
+	nodeID := ctl.GetMQTTHassNodeId()
+	entities := b.hassEntities(ctl)
+	device := models.NewHassDeviceDiscoveryConfig(ctl.GetMQTTHassDevice())
+	device.Add(entities...)
+	sensorDevices := map[string]*models.HassDeviceDiscoveryConfig{}
+	removedDevices := make([]string, 0)
+	for _, sensor := range ctl.GetSensors() {
+		if !sensor.IsConfigured() {
+			continue
+		}
+		sensorEntities := sensor.GetMQTTHassEntities(b.config.MQTT.BaseTopic)
+		entities = append(entities, sensorEntities...)
+		removed := sensor.IsIgnored() || slices.Contains(expired, sensor)
+		if sensor.IsIgnored() {
+			b.clearSensorState(sensor)
+		}
+		if !sensor.HasOwnDevice() {
+			if removed {
+				device.Remove(sensorEntities...)
+			} else {
+				device.Add(sensorEntities...)
+			}
+			continue
+		}
+		topic := sensor.GetMQTTHassDeviceConfigTopic(b.config.HassDiscoveryTopic)
+		if removed {
+			removedDevices = append(removedDevices, topic)
+			continue
+		}
+		sensorDevice := models.NewHassDeviceDiscoveryConfig(sensor.GetMQTTHassDevice())
+		sensorDevice.Add(sensorEntities...)
+		sensorDevices[topic] = sensorDevice
+	}
+
+	entityTopics := make([]string, 0, len(entities))
+	for _, entity := range entities {
+		entityTopics = append(entityTopics, entity.GetTopic(b.config.HassDiscoveryTopic, nodeID))
+	}
+	b.migrateHassDiscovery(entityTopics)
+	b.cli.PublishDiscovery(ctl.GetMQTTHassDeviceConfigTopic(b.config.HassDiscoveryTopic), device)
+	for topic, sensorDevice := range sensorDevices {
+		b.cli.PublishDiscovery(topic, sensorDevice)
+	}
+	for _, topic := range removedDevices {
+		b.cli.ClearRetained(topic)
+	}
+	b.clearMigratedHassDiscovery(entityTopics)
+}
+
+// migrateHassDiscovery tell Home Assistant to keep the entities of the discovery topics of the other mode
+func (b *Bridge) migrateHassDiscovery(topics []string) {
+	if !b.config.HassDiscoveryMigrate {
+		return
+	}
+	for _, topic := range topics {
+		b.cli.PublishDiscovery(topic, &models.HassMigrateDiscovery{MigrateDiscovery: true})
+	}
+}
+
+// clearMigratedHassDiscovery clear the discovery topics of the other mode once the new ones are published
+func (b *Bridge) clearMigratedHassDiscovery(topics []string) {
+	if !b.config.HassDiscoveryMigrate {
+		return
+	}
+	for _, topic := range topics {
+		b.cli.ClearRetained(topic)
+	}
+}
+
+// clearSensorState clear the retained availability and state of a sensor no longer published
+func (b *Bridge) clearSensorState(sensor *models.LeakoSensor) {
+	b.cli.ClearRetained(sensor.GetMQTTAvailabilityTopic(b.config.MQTT.BaseTopic))
+	b.cli.ClearRetained(sensor.GetMQTTStateTopic(b.config.MQTT.BaseTopic))
+}
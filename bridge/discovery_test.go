@@ -0,0 +1,163 @@
+package bridge
+
+import (
+	"akwatek-mqtt-bridge/models"
+	"akwatek-mqtt-bridge/utils"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// deviceDiscovery is the single discovery message of a device, as Home Assistant read it
+type deviceDiscovery struct {
+	Device     map[string]any            `json:"device"`
+	Origin     map[string]any            `json:"origin"`
+	Components map[string]map[string]any `json:"components"`
+}
+
+func newDiscoveryBridge(mode string, migrate bool) (*Bridge, *fakePublisher) {
+	b, publisher, _ := newBridge()
+	b.config.HassDiscoveryEnabled = true
+	b.config.HassDiscoveryTopic = "homeassistant"
+	b.config.HassDiscoveryMode = mode
+	b.config.HassDiscoveryMigrate = migrate
+	b.config.SensorRemovalGrace = 50 * time.Millisecond
+	return b, publisher
+}
+
+// lastDevice return the last device discovery of the controller
+func lastDevice(t *testing.T, b *Bridge, publisher *fakePublisher) *deviceDiscovery {
+	t.Helper()
+	ctl := b.registry.List()[0]
+	topic := ctl.GetMQTTHassDeviceConfigTopic(b.config.HassDiscoveryTopic)
+	payload, ok := publisher.last(topic)
+	if !ok || payload == "" {
+		t.Fatalf("no device discovery on %s", topic)
+	}
+	var device deviceDiscovery
+	if err := json.Unmarshal([]byte(payload), &device); err != nil {
+		t.Fatal(err)
+	}
+	return &device
+}
+
+func TestDeviceDiscovery(t *testing.T) {
+	b, publisher := newDiscoveryBridge(utils.HASS_DISCOVERY_DEVICE, false)
+	checkIn(t, b, "18041", "11")
+	ctl := b.registry.List()[0]
+	device := lastDevice(t, b, publisher)
+
+	if fmt.Sprint(device.Device["identifiers"]) != fmt.Sprintf("[%s]", ctl.GetMQTTHassNodeId()) ||
+		fmt.Sprint(device.Device["connections"]) != fmt.Sprintf("[[mac %s]]", mac) ||
+		device.Device["manufacturer"] != models.MANUFACTURER || device.Device["model"] != models.CTL_MODEL {
+		t.Errorf("unexpected device %v", device.Device)
+	}
+	if device.Origin["name"] != models.HASS_ORIGIN {
+		t.Errorf("unexpected origin %v", device.Origin)
+	}
+	for _, entity := range append(ctl.GetMQTTHassEntities(b.config.MQTT.BaseTopic), ctl.GetSensors()[1].GetMQTTHassEntities(b.config.MQTT.BaseTopic)...) {
+		component, ok := device.Components[entity.ObjectID]
+		if !ok {
+			t.Errorf("no component %s", entity.ObjectID)
+			continue
+		}
+		if component["platform"] != entity.Component || component["unique_id"] != entity.Config.UniqueId || component["state_topic"] != entity.Config.StateTopic {
+			t.Errorf("unexpected component %s %v", entity.ObjectID, component)
+		}
+		// the device is only set once for the whole discovery
+		if _, ok := component["device"]; ok {
+			t.Errorf("device in component %s", entity.ObjectID)
+		}
+	}
+	// the entities aren't published on their own topic
+	for _, entity := range ctl.GetMQTTHassEntities(b.config.MQTT.BaseTopic) {
+		if _, ok := publisher.last(entity.GetTopic(b.config.HassDiscoveryTopic, ctl.GetMQTTHassNodeId())); ok {
+			t.Errorf("entity %s published in device mode", entity.ObjectID)
+		}
+	}
+}
+
+func TestDeviceDiscoveryRemovedComponent(t *testing.T) {
+	b, publisher := newDiscoveryBridge(utils.HASS_DISCOVERY_DEVICE, false)
+	checkIn(t, b, "18041", "11")
+	checkIn(t, b, "18041", "10")
+	if _, ok := lastDevice(t, b, publisher).Components["sensor-2-leak"]["unique_id"]; !ok {
+		t.Fatalf("sensor 2 removed within the grace period")
+	}
+	time.Sleep(2 * b.config.SensorRemovalGrace)
+	checkIn(t, b, "18041", "10")
+
+	device := lastDevice(t, b, publisher)
+	for _, objectID := range []string{"sensor-2-bat", "sensor-2-leak", "sensor-2-lost"} {
+		// only the platform, so Home Assistant remove the entity
+		if component := device.Components[objectID]; len(component) != 1 || component["platform"] != "binary_sensor" {
+			t.Errorf("got component %s %v, expected only its platform", objectID, component)
+		}
+	}
+	if component := device.Components["sensor-1-leak"]; component["unique_id"] == nil {
+		t.Errorf("sensor 1 removed %v", component)
+	}
+}
+
+func TestDiscoveryMigration(t *testing.T) {
+	tests := []struct {
+		mode string
+		// the topics of the other mode, migrated then cleared, and the new ones
+		migrated  func(b *Bridge, ctl *models.AkwatekCtl) []string
+		published func(b *Bridge, ctl *models.AkwatekCtl) []string
+	}{
+		{
+			mode: utils.HASS_DISCOVERY_DEVICE,
+			migrated: func(b *Bridge, ctl *models.AkwatekCtl) []string {
+				topics := make([]string, 0)
+				for _, entity := range ctl.GetMQTTHassEntities(b.config.MQTT.BaseTopic) {
+					topics = append(topics, entity.GetTopic(b.config.HassDiscoveryTopic, ctl.GetMQTTHassNodeId()))
+				}
+				return append(topics, ctl.GetSensors()[0].GetMQTTHassConfigTopics(b.config.HassDiscoveryTopic)...)
+			},
+			published: func(b *Bridge, ctl *models.AkwatekCtl) []string {
+				return []string{ctl.GetMQTTHassDeviceConfigTopic(b.config.HassDiscoveryTopic)}
+			},
+		},
+		{
+			mode: utils.HASS_DISCOVERY_ENTITY,
+			migrated: func(b *Bridge, ctl *models.AkwatekCtl) []string {
+				return []string{ctl.GetMQTTHassDeviceConfigTopic(b.config.HassDiscoveryTopic)}
+			},
+			published: func(b *Bridge, ctl *models.AkwatekCtl) []string {
+				return ctl.GetSensors()[0].GetMQTTHassConfigTopics(b.config.HassDiscoveryTopic)
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.mode, func(t *testing.T) {
+			b, publisher := newDiscoveryBridge(test.mode, true)
+			checkIn(t, b, "18041", "1")
+			ctl := b.registry.List()[0]
+
+			migrate := `{"migrate_discovery":true}`
+			firstPublished := len(publisher.sequence)
+			for _, topic := range test.published(b, ctl) {
+				payload, _ := publisher.last(topic)
+				firstPublished = min(firstPublished, publisher.index(topic, payload))
+			}
+			lastMigrated := -1
+			for _, topic := range test.migrated(b, ctl) {
+				migrated, cleared := publisher.index(topic, migrate), publisher.index(topic, "")
+				if migrated == -1 || cleared == -1 {
+					t.Errorf("%s not migrated then cleared", topic)
+					continue
+				}
+				lastMigrated = max(lastMigrated, migrated)
+				// cleared once the new discovery is published
+				if cleared < firstPublished {
+					t.Errorf("%s cleared before the new discovery", topic)
+				}
+			}
+			if firstPublished == -1 || lastMigrated >= firstPublished {
+				t.Errorf("new discovery published at %d, before the migration at %d", firstPublished, lastMigrated)
+			}
+		})
+	}
+}
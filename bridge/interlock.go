@@ -0,0 +1,59 @@
+package bridge
+
+import (
+	"akwatek-mqtt-bridge/models"
+	"akwatek-mqtt-bridge/utils"
+	"encoding/json"
+	"fmt"
+	"github.com/rs/zerolog/log"
+)
+
+// interlock return why an opening of the valve is refused, empty if it's allowed
+func (b *Bridge) interlock(ctl *models.AkwatekCtl) string {
+	if b.config.ValveCommand.Interlock == utils.VALVE_INTERLOCK_OFF {
+		return ""
+	}
+	if ctl.HasAlarm() {
+		return "the alarm is on"
+	}
+	if water, zone := ctl.HasWater(); water {
+		return fmt.Sprintf("water detected by the sensor of zone %d", zone)
+	}
+	return ""
+}
+
+// checkInterlock refuse an opening while a leak is active, unless it carry a valid override token
+func (b *Bridge) checkInterlock(ctl *models.AkwatekCtl, command *models.ValveCommand) error {
+	if command.Action != models.VALVE_ACTION_OPEN {
+		return nil
+	}
+	reason := b.interlock(ctl)
+	if reason == "" {
+		return nil
+	}
+	if b.config.ValveCommand.Interlock != utils.VALVE_INTERLOCK_OVERRIDE {
+		return fmt.Errorf("interlock: %s", reason)
+	}
+	if command.OverrideToken == "" || !ctl.UseValveOverride(command.OverrideToken) {
+		return fmt.Errorf("interlock: %s, an override token is required", reason)
+	}
+	log.Warn().Msgf("interlock of %s overridden: %s", ctl.MAC, reason)
+	command.Override = true
+	return nil
+}
+
+// valveOverrideCallback answer an override request with a new token, to be sent with the opening
+func (b *Bridge) valveOverrideCallback(ctl *models.AkwatekCtl) func(payload []byte) json.Marshaler {
+	return func(payload []byte) json.Marshaler {
+		if b.config.ValveCommand.Interlock != utils.VALVE_INTERLOCK_OVERRIDE {
+			return b.rejectValveCommand(ctl, payload, fmt.Errorf("the interlock override is disabled"))
+		}
+		override, err := ctl.NewValveOverride(b.config.ValveCommand.OverrideTTL)
+		if err != nil {
+			return b.rejectValveCommand(ctl, payload, err)
+		}
+		log.Info().Msgf("interlock override token of %s valid until %s", ctl.MAC, override.ExpiresAt)
+		b.cli.PublishValveOverride(ctl.GetMQTTValveOverrideTokenTopic(b.config.MQTT.BaseTopic), override, ctl.GetMQTTUserProperties())
+		return override
+	}
+}
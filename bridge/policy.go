@@ -0,0 +1,29 @@
+package bridge
+
+import (
+	"akwatek-mqtt-bridge/models"
+	"github.com/rs/zerolog/log"
+	"time"
+)
+
+// applyPolicy queue a closing of the valve for every rule that just fired,
+// it return the commands and the events explaining why, to be published in order with the check-in
+func (b *Bridge) applyPolicy(ctl *models.AkwatekCtl) ([]*models.ValveCommand, []*models.Event) {
+	commands := make([]*models.ValveCommand, 0)
+	events := make([]*models.Event, 0)
+	if b.policy == nil {
+		return commands, events
+	}
+	for _, firing := range b.policy.Evaluate(ctl, time.Now()) {
+		log.Warn().Msgf("policy %s fired for %s: %s", firing.Rule.Name(), ctl.MAC, firing.Reason)
+		command := models.NewValveCommand(models.VALVE_ACTION_CLOSE, models.VALVE_COMMAND_POLICY+firing.Rule.Name(), firing.Reason)
+		commands = append(commands, b.queueValveCommand(ctl, command)...)
+
+		event := models.NewEvent(ctl, models.EVENT_POLICY_TRIGGERED, firing.Reason)
+		event.Attributes["policy"] = firing.Rule.Name()
+		event.Attributes["type"] = firing.Rule.Type()
+		event.Attributes["command"] = command.ID
+		events = append(events, event)
+	}
+	return commands, events
+}
@@ -0,0 +1,51 @@
+package bridge
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"github.com/rs/zerolog/log"
+	"os"
+	"time"
+)
+
+// Replay feed a capture file through the check-in pipeline,
+// speed accelerate the delay between records, 0 replay them without delay
+func (b *Bridge) Replay(path string, speed float64) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	var previous time.Time
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var record CaptureRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			log.Error().Err(err).Msgf("failed to decode capture line %d", line)
+			continue
+		}
+		if speed > 0 && !previous.IsZero() && record.Time.After(previous) {
+			time.Sleep(time.Duration(float64(record.Time.Sub(previous)) / speed))
+		}
+		previous = record.Time
+
+		log.Info().Msgf("Replaying check-in of %s (line %d)", record.Time.Format(time.RFC3339), line)
+		res, err := b.CheckIn(record.Request, nil)
+		if err != nil {
+			log.Error().Err(err).Msgf("failed to replay capture line %d", line)
+		} else if response, _ := json.Marshal(res); !bytes.Equal(response, record.Response) {
+			log.Warn().Msgf("replayed response %s differ from the captured one %s", response, record.Response)
+		}
+		// keep the publications in the order of the capture
+		b.Wait()
+	}
+	return scanner.Err()
+}
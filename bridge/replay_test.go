@@ -0,0 +1,118 @@
+package bridge
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readCapture return the records of a capture file
+func readCapture(t *testing.T, path string) []*CaptureRecord {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	records := make([]*CaptureRecord, 0)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var record CaptureRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, &record)
+	}
+	return records
+}
+
+// capture return a bridge recording its check-ins to a new file in dir
+func capture(t *testing.T, dir string, name string) (*Bridge, *fakeSink, string) {
+	t.Helper()
+	b, _, fake := newBridge()
+	path := filepath.Join(dir, name)
+	c, err := NewCapture(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	b.SetCapture(c)
+	return b, fake, path
+}
+
+func TestCaptureReplay(t *testing.T) {
+	dir := t.TempDir()
+	b, fake, path := capture(t, dir, "capture.jsonl")
+	checkIn(t, b, "18041", "111")
+	checkIn(t, b, "18041", "191")
+	checkIn(t, b, "18141", "191")
+	if _, err := b.CheckIn([]byte("not json"), nil); err == nil {
+		t.Fatal("expected an error for an invalid check-in")
+	}
+	recorded := readCapture(t, path)
+	if len(recorded) != 4 || recorded[3].Status != 400 {
+		t.Fatalf("unexpected capture %+v", recorded)
+	}
+
+	replayed, replayedFake, replayedPath := capture(t, dir, "replay.jsonl")
+	start := time.Now()
+	if err := replayed.Replay(path, 0); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("replay without delay took %s", elapsed)
+	}
+
+	records := readCapture(t, replayedPath)
+	if len(records) != len(recorded) {
+		t.Fatalf("got %d replayed check-ins, expected %d", len(records), len(recorded))
+	}
+	for i, record := range records {
+		if string(record.Request) != string(recorded[i].Request) || record.Status != recorded[i].Status ||
+			string(record.Response) != string(recorded[i].Response) {
+			t.Errorf("check-in %d: replayed %+v, expected %+v", i+1, record, recorded[i])
+		}
+	}
+	if !slices.Equal(replayedFake.states, fake.states) {
+		t.Errorf("replayed states %v, expected %v", replayedFake.states, fake.states)
+	}
+}
+
+func TestReplaySpeed(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "capture.jsonl")
+	start := time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC)
+	lines := make([]byte, 0)
+	for i, status := range []string{"18041", "18040"} {
+		request := fmt.Sprintf(`{"Itek_V1":{"MAC_address":%q,"ID":"1.0","Cont_status":%q,"zone01-25":"111"}}`, mac, status)
+		line, _ := json.Marshal(&CaptureRecord{
+			Time:     start.Add(time.Duration(i) * time.Second),
+			Request:  json.RawMessage(request),
+			Status:   200,
+			Response: json.RawMessage(`{"Itek_V1":{"mess":"OK"}}`),
+		})
+		lines = append(append(lines, line...), '\n')
+	}
+	if err := os.WriteFile(path, lines, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	b, _, fake := newBridge()
+	replayStart := time.Now()
+	// 1s between the check-ins, 200ms at 5x
+	if err := b.Replay(path, 5); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(replayStart); elapsed < 200*time.Millisecond || elapsed > time.Second {
+		t.Errorf("replay at 5x took %s, expected 200ms", elapsed)
+	}
+	if len(fake.states) != 2 || !strings.Contains(fake.states[1], `"valve":false`) {
+		t.Errorf("unexpected replayed states %v", fake.states)
+	}
+}
@@ -0,0 +1,63 @@
+package bridge
+
+import (
+	"akwatek-mqtt-bridge/models"
+	"github.com/rs/zerolog/log"
+	"time"
+)
+
+// applySchedules queue the valve commands of the schedules due on this check-in
+func (b *Bridge) applySchedules(ctl *models.AkwatekCtl) []*models.ValveCommand {
+	commands := make([]*models.ValveCommand, 0)
+	if b.scheduler == nil {
+		return commands
+	}
+	for _, command := range b.scheduler.Evaluate(ctl, time.Now()) {
+		if err := b.checkInterlock(ctl, command); err != nil {
+			log.Warn().Err(err).Msgf("%s for %s refused", command.Source, ctl.MAC)
+			continue
+		}
+		log.Info().Msgf("%s for %s: %s", command.Source, ctl.MAC, command.Reason)
+		commands = append(commands, b.queueValveCommand(ctl, command)...)
+	}
+	return commands
+}
+
+// watchSchedules subscribe to the switches enabling the schedules of the controller
+func (b *Bridge) watchSchedules(ctl *models.AkwatekCtl) {
+	if b.scheduler == nil {
+		return
+	}
+	for _, schedule := range b.scheduler.Schedules(ctl) {
+		name := schedule.Name
+		b.cli.WatchSwitch(ctl.GetMQTTScheduleCommandTopic(b.config.MQTT.BaseTopic, name), func(on bool) {
+			if !ctl.SetScheduleEnabled(name, on) {
+				return
+			}
+			log.Info().Msgf("schedule %s of %s enabled=%t", name, ctl.MAC, on)
+			b.cli.PublishSwitchState(ctl.GetMQTTScheduleStateTopic(b.config.MQTT.BaseTopic, name), on)
+			b.SaveCtl(ctl)
+		})
+	}
+}
+
+// scheduleHassEntities return the switches enabling the schedules of the controller
+func (b *Bridge) scheduleHassEntities(ctl *models.AkwatekCtl) []*models.HassEntity {
+	entities := make([]*models.HassEntity, 0)
+	if b.scheduler == nil {
+		return entities
+	}
+	for _, schedule := range b.scheduler.Schedules(ctl) {
+		entities = append(entities, ctl.GetMQTTScheduleHassEntity(b.config.MQTT.BaseTopic, schedule.Name))
+	}
+	return entities
+}
+
+func (b *Bridge) PublishSchedulesState(ctl *models.AkwatekCtl) {
+	if b.scheduler == nil {
+		return
+	}
+	for _, schedule := range b.scheduler.Schedules(ctl) {
+		b.cli.PublishSwitchState(ctl.GetMQTTScheduleStateTopic(b.config.MQTT.BaseTopic, schedule.Name), ctl.IsScheduleEnabled(schedule.Name))
+	}
+}
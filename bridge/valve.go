@@ -0,0 +1,92 @@
+package bridge
+
+import (
+	"akwatek-mqtt-bridge/models"
+	"encoding/json"
+	"fmt"
+	"github.com/rs/zerolog/log"
+)
+
+// valveCommandCallback queue the valve command received on MQTT, it's persisted so it's not lost on restart.
+// Unknown payloads are refused, an accidental closing of the water line isn't acceptable.
+func (b *Bridge) valveCommandCallback(ctl *models.AkwatekCtl) func(payload []byte) json.Marshaler {
+	return func(payload []byte) json.Marshaler {
+		command, err := models.ParseValveCommand(payload)
+		if err != nil {
+			return b.rejectValveCommand(ctl, payload, err)
+		}
+		if err := b.checkInterlock(ctl, command); err != nil {
+			return b.rejectValveCommand(ctl, payload, err)
+		}
+		if superseded := ctl.QueueValveCommand(command); superseded != nil {
+			b.PublishValveResult(ctl, superseded)
+		}
+		b.PublishValveResult(ctl, command)
+		b.SaveCtl(ctl)
+		return command
+	}
+}
+
+// rejectValveCommand publish why a valve command is refused, so Home Assistant show why nothing happened
+func (b *Bridge) rejectValveCommand(ctl *models.AkwatekCtl, payload []byte, err error) json.Marshaler {
+	rejection := models.NewValveCommandRejection(payload, err)
+	log.Warn().Err(err).Msgf("valve command of %s refused", ctl.MAC)
+	b.cli.PublishValveError(ctl.GetMQTTValveErrorTopic(b.config.MQTT.BaseTopic), rejection, ctl.GetMQTTUserProperties())
+	return rejection
+}
+
+// queueValveCommand queue a command decided by the bridge itself,
+// it return the superseded command if any and the queued one, to be published in this order
+func (b *Bridge) queueValveCommand(ctl *models.AkwatekCtl, command *models.ValveCommand) []*models.ValveCommand {
+	if superseded := ctl.QueueValveCommand(command); superseded != nil {
+		return []*models.ValveCommand{superseded, command}
+	}
+	return []*models.ValveCommand{command}
+}
+
+// mergeCloudValve return the valve action sent to the controller when the cloud send one too,
+// a closing of a policy wins whatever the priority, an opening from the cloud goes through the interlock like a MQTT one,
+// the local action is kept if it's refused
+func (b *Bridge) mergeCloudValve(ctl *models.AkwatekCtl, sent *models.ValveCommand, cloud *models.ValveAction) *models.ValveAction {
+	var local *models.ValveAction
+	if sent != nil {
+		local = &sent.Action
+		if sent.IsPolicy() {
+			if cloud != nil && *cloud != sent.Action {
+				log.Warn().Msgf("valve action from cloud (%s) ignored, %s closing for safety", *cloud, sent.Source)
+			}
+			return local
+		}
+	}
+	merged := b.upstream.MergeValve(local, cloud)
+	if merged == nil || *merged != models.VALVE_ACTION_OPEN || (local != nil && *local == *merged) {
+		return merged
+	}
+	if reason := b.interlock(ctl); reason != "" {
+		b.rejectValveCommand(ctl, []byte(merged.String()), fmt.Errorf("interlock: %s, opening from the cloud refused", reason))
+		return local
+	}
+	return merged
+}
+
+// dryRun return the event of a valve action not sent to the controller
+func (b *Bridge) dryRun(ctl *models.AkwatekCtl, action models.ValveAction) *models.Event {
+	log.Warn().Msgf("dry-run, valve action %s not sent to %s", action, ctl.MAC)
+	event := models.NewEvent(ctl, models.EVENT_DRY_RUN_VALVE, fmt.Sprintf("valve action %s not sent, dry-run", action))
+	event.Attributes["action"] = action.String()
+	return event
+}
+
+// PublishValveResult publish a step of the valve command lifecycle on the result topic,
+// and the history once the command is done
+func (b *Bridge) PublishValveResult(ctl *models.AkwatekCtl, command *models.ValveCommand) {
+	if command.Status == models.VALVE_COMMAND_FAILED {
+		log.Warn().Msgf("valve command of %s failed: %s", ctl.MAC, command.Error)
+	} else {
+		log.Info().Msgf("valve command of %s: %s", ctl.MAC, command)
+	}
+	b.cli.PublishValveResult(ctl.GetMQTTValveResultTopic(b.config.MQTT.BaseTopic), command, ctl.GetMQTTUserProperties())
+	if command.IsDone() {
+		b.cli.PublishValveHistory(ctl.GetMQTTValveHistoryTopic(b.config.MQTT.BaseTopic), ctl.GetValveCommandHistory())
+	}
+}
@@ -0,0 +1,64 @@
+package bridge
+
+import (
+	"akwatek-mqtt-bridge/models"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"time"
+)
+
+// isStale return true if the controller missed too many check-ins
+func (b *Bridge) isStale(ctl *models.AkwatekCtl, now time.Time) bool {
+	timeout := b.config.CheckInInterval * time.Duration(b.config.OfflineMissedCheckIns)
+	return ctl.GetLastSeen().Add(timeout).Before(now)
+}
+
+// Watchdog publish "offline" availability for the controllers that stopped checking in
+func (b *Bridge) Watchdog() {
+	ticker := time.NewTicker(b.config.CheckInInterval)
+	defer ticker.Stop()
+	for {
+		b.checkStale(time.Now())
+		<-ticker.C
+	}
+}
+
+// checkStale mark offline the controllers that became stale at now
+func (b *Bridge) checkStale(now time.Time) {
+	for _, ctl := range b.registry.List() {
+		if !b.isStale(ctl, now) || !ctl.SetOffline(true) {
+			continue
+		}
+		log.Warn().Msgf("Controller %s is offline, last check-in at %s", ctl.MAC, ctl.GetLastSeen().Format(time.RFC3339))
+		b.PublishCtlOffline(ctl)
+		event := models.NewEvent(ctl, models.EVENT_CONTROLLER_OFFLINE,
+			fmt.Sprintf("no check-in since %s", ctl.GetLastSeen().Format(time.RFC3339)))
+		event.Attributes["last_seen"] = ctl.GetLastSeen()
+		event.Attributes["missed_checkins"] = b.config.OfflineMissedCheckIns
+		b.PublishEvent(ctl, event)
+	}
+}
+
+// markOnline return the event to publish if the controller was offline, nil otherwise
+func (b *Bridge) markOnline(ctl *models.AkwatekCtl) *models.Event {
+	if !ctl.SetOffline(false) {
+		return nil
+	}
+	log.Info().Msgf("Controller %s is back online", ctl.MAC)
+	return models.NewEvent(ctl, models.EVENT_CONTROLLER_ONLINE, "check-in received")
+}
+
+func (b *Bridge) PublishCtlOffline(ctl *models.AkwatekCtl) {
+	b.publishSinks(ctl)
+	b.PublishDiagnostics(ctl)
+	if b.homie != nil {
+		b.homie.SetLost(ctl)
+	}
+}
+
+func (b *Bridge) PublishEvent(ctl *models.AkwatekCtl, event *models.Event) {
+	b.cli.PublishEvent(ctl.GetMQTTEventTopic(b.config.MQTT.BaseTopic), event, ctl.GetMQTTUserProperties())
+	if b.notifier != nil {
+		b.notifier.Notify(event)
+	}
+}
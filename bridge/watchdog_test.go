@@ -0,0 +1,42 @@
+package bridge
+
+import (
+	"akwatek-mqtt-bridge/models"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestWatchdogOfflineOnline(t *testing.T) {
+	b, publisher, fake := newBridge()
+	b.config.CheckInInterval = 20 * time.Millisecond
+	b.config.OfflineMissedCheckIns = 2
+	checkIn(t, b, "18041", "111")
+
+	// one missed check-in is tolerated
+	time.Sleep(b.config.CheckInInterval)
+	b.checkStale(time.Now())
+	if types := events(t, publisher, models.EVENT_CONTROLLER_OFFLINE, models.EVENT_CONTROLLER_ONLINE); len(types) != 0 || len(fake.records) != 1 {
+		t.Fatalf("got events %v and %d records before the timeout, expected none", types, len(fake.records))
+	}
+
+	time.Sleep(2 * b.config.CheckInInterval)
+	b.checkStale(time.Now())
+	// published once, not on every pass of the watchdog
+	b.checkStale(time.Now())
+	if types := events(t, publisher, models.EVENT_CONTROLLER_OFFLINE, models.EVENT_CONTROLLER_ONLINE); len(types) != 1 || types[0] != models.EVENT_CONTROLLER_OFFLINE {
+		t.Fatalf("got events %v, expected %s", types, models.EVENT_CONTROLLER_OFFLINE)
+	}
+	if len(fake.records) != 2 || !fake.records[1].Offline {
+		t.Fatalf("offline state not published to the sinks")
+	}
+
+	checkIn(t, b, "18041", "111")
+	expected := []string{models.EVENT_CONTROLLER_OFFLINE, models.EVENT_CONTROLLER_ONLINE}
+	if types := events(t, publisher, models.EVENT_CONTROLLER_OFFLINE, models.EVENT_CONTROLLER_ONLINE); !slices.Equal(types, expected) {
+		t.Errorf("got events %v, expected %v", types, expected)
+	}
+	if len(fake.records) != 3 || fake.records[2].Offline {
+		t.Errorf("online state not published to the sinks")
+	}
+}
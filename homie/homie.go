@@ -0,0 +1,252 @@
+package homie
+
+import (
+	"akwatek-mqtt-bridge/models"
+	"akwatek-mqtt-bridge/utils"
+	"encoding/json"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	HOMIE_VERSION      string = "4.0.0"
+	STATE_INIT         string = "init"
+	STATE_READY        string = "ready"
+	STATE_DISCONNECTED string = "disconnected"
+	STATE_LOST         string = "lost"
+	CONTROLLER_NODE    string = "controller"
+)
+
+// property is the definition of a Homie property, Format is the values of an enum
+type property struct {
+	ID       string
+	Name     string
+	Datatype string
+	Format   string
+	Settable bool
+}
+
+var controllerProperties = []*property{
+	{ID: "valve", Name: "Valve", Datatype: "enum", Format: "open,closed,opening,closing", Settable: true},
+	{ID: "power", Name: "Power line", Datatype: "boolean"},
+	{ID: "battery", Name: "Battery OK", Datatype: "boolean"},
+	{ID: "alarm", Name: "Alarm", Datatype: "boolean"},
+}
+
+var sensorProperties = []*property{
+	{ID: "leak", Name: "Leak", Datatype: "boolean"},
+	{ID: "low-bat", Name: "Low battery", Datatype: "boolean"},
+	{ID: "lost-signal", Name: "Lost signal", Datatype: "boolean"},
+}
+
+// device is what was published for a controller, its nodes are published again when they change
+type device struct {
+	nodes []string
+	state string
+}
+
+// Publisher is the MQTT topics of the Homie devices, *mqtt_client.Client implement it
+type Publisher interface {
+	PublishHomie(topic string, value string)
+	ClearRetained(topic string)
+	WatchCommand(topicID string, callback func(payload []byte) json.Marshaler)
+}
+
+// Homie publish every controller as a Homie device, with a controller node and a node per sensor,
+// https://homieiot.github.io/specification/spec-core-v4_0_0/. It isn't fully compliant: the bridge has a single
+// MQTT connection and last will, a crash of the bridge can't set every device lost
+type Homie struct {
+	cli       Publisher
+	baseTopic string
+	mu        sync.Mutex
+	devices   map[string]*device
+}
+
+func NewHomie(config *utils.Config, cli Publisher) *Homie {
+	return &Homie{
+		cli:       cli,
+		baseTopic: config.HomieBaseTopic,
+		devices:   map[string]*device{},
+	}
+}
+
+// GetDeviceID is the Homie device id of a controller, lower case letters, digits and -
+func GetDeviceID(ctl *models.AkwatekCtl) string {
+	return fmt.Sprintf("%s-%s", models.MANUFACTURER_PREFIX, ctl.GetIdentifier())
+}
+
+// GetSensorNodeID is the Homie node id of a sensor
+func GetSensorNodeID(sensor *models.LeakoSensor) string {
+	return fmt.Sprintf("sensor-%d", sensor.ID)
+}
+
+func (h *Homie) getDeviceTopic(ctl *models.AkwatekCtl) string {
+	return fmt.Sprintf("%s/%s", h.baseTopic, GetDeviceID(ctl))
+}
+
+// GetValveCommandTopic is the set topic of the valve property
+func (h *Homie) GetValveCommandTopic(ctl *models.AkwatekCtl) string {
+	return fmt.Sprintf("%s/%s/valve/set", h.getDeviceTopic(ctl), CONTROLLER_NODE)
+}
+
+// sensors return the sensors published as nodes, the ignored ones excluded
+func sensors(ctl *models.AkwatekCtl) []*models.LeakoSensor {
+	published := make([]*models.LeakoSensor, 0)
+	for _, sensor := range ctl.GetSensors() {
+		if sensor.IsConfigured() && !sensor.IsRemoved() && !sensor.IsIgnored() {
+			published = append(published, sensor)
+		}
+	}
+	return published
+}
+
+func nodeIDs(ctl *models.AkwatekCtl) []string {
+	nodes := []string{CONTROLLER_NODE}
+	for _, sensor := range sensors(ctl) {
+		nodes = append(nodes, GetSensorNodeID(sensor))
+	}
+	return nodes
+}
+
+// PublishDevice publish the attributes and the values of every node of the controller,
+// the device is in the init state meanwhile, then ready or lost if the controller is offline
+func (h *Homie) PublishDevice(ctl *models.AkwatekCtl) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.publishDevice(ctl)
+}
+
+func (h *Homie) publishDevice(ctl *models.AkwatekCtl) {
+	deviceTopic := h.getDeviceTopic(ctl)
+	nodes := nodeIDs(ctl)
+	h.cli.PublishHomie(deviceTopic+"/$state", STATE_INIT)
+	h.cli.PublishHomie(deviceTopic+"/$homie", HOMIE_VERSION)
+	h.cli.PublishHomie(deviceTopic+"/$name", ctl.GetName())
+	h.cli.PublishHomie(deviceTopic+"/$extensions", "")
+	h.cli.PublishHomie(deviceTopic+"/$nodes", strings.Join(nodes, ","))
+
+	// the nodes of the sensors removed since the last publication are cleared
+	if previous, ok := h.devices[GetDeviceID(ctl)]; ok {
+		for _, node := range previous.nodes {
+			if !slices.Contains(nodes, node) {
+				h.clearNode(deviceTopic, node, sensorProperties)
+			}
+		}
+	}
+
+	h.publishNode(deviceTopic, CONTROLLER_NODE, ctl.GetName(), models.CTL_MODEL, controllerProperties)
+	for _, sensor := range sensors(ctl) {
+		name := sensor.Ctl.GetZone(sensor.ID).Name
+		if name == "" {
+			name = fmt.Sprintf("Zone %d", sensor.ID)
+		}
+		h.publishNode(deviceTopic, GetSensorNodeID(sensor), name, models.SENSOR_MODEL, sensorProperties)
+	}
+	h.publishValues(ctl)
+
+	state := STATE_READY
+	if ctl.IsOffline() {
+		state = STATE_LOST
+	}
+	h.cli.PublishHomie(deviceTopic+"/$state", state)
+	h.devices[GetDeviceID(ctl)] = &device{nodes: nodes, state: state}
+}
+
+func (h *Homie) publishNode(deviceTopic string, node string, name string, nodeType string, properties []*property) {
+	nodeTopic := fmt.Sprintf("%s/%s", deviceTopic, node)
+	ids := make([]string, 0, len(properties))
+	for _, p := range properties {
+		ids = append(ids, p.ID)
+	}
+	h.cli.PublishHomie(nodeTopic+"/$name", name)
+	h.cli.PublishHomie(nodeTopic+"/$type", nodeType)
+	h.cli.PublishHomie(nodeTopic+"/$properties", strings.Join(ids, ","))
+	for _, p := range properties {
+		propertyTopic := fmt.Sprintf("%s/%s", nodeTopic, p.ID)
+		h.cli.PublishHomie(propertyTopic+"/$name", p.Name)
+		h.cli.PublishHomie(propertyTopic+"/$datatype", p.Datatype)
+		if p.Format != "" {
+			h.cli.PublishHomie(propertyTopic+"/$format", p.Format)
+		}
+		if p.Settable {
+			h.cli.PublishHomie(propertyTopic+"/$settable", "true")
+		}
+	}
+}
+
+func (h *Homie) clearNode(deviceTopic string, node string, properties []*property) {
+	nodeTopic := fmt.Sprintf("%s/%s", deviceTopic, node)
+	for _, attribute := range []string{"$name", "$type", "$properties"} {
+		h.cli.ClearRetained(fmt.Sprintf("%s/%s", nodeTopic, attribute))
+	}
+	for _, p := range properties {
+		propertyTopic := fmt.Sprintf("%s/%s", nodeTopic, p.ID)
+		for _, attribute := range []string{"", "/$name", "/$datatype", "/$format", "/$settable"} {
+			h.cli.ClearRetained(propertyTopic + attribute)
+		}
+	}
+}
+
+func (h *Homie) publishValues(ctl *models.AkwatekCtl) {
+	controllerTopic := fmt.Sprintf("%s/%s", h.getDeviceTopic(ctl), CONTROLLER_NODE)
+	h.cli.PublishHomie(controllerTopic+"/valve", ctl.ValveState())
+	h.cli.PublishHomie(controllerTopic+"/power", strconv.FormatBool(ctl.HasPowerLine()))
+	h.cli.PublishHomie(controllerTopic+"/battery", strconv.FormatBool(ctl.HasBattery()))
+	h.cli.PublishHomie(controllerTopic+"/alarm", strconv.FormatBool(ctl.HasAlarm()))
+	for _, sensor := range sensors(ctl) {
+		sensorTopic := fmt.Sprintf("%s/%s", h.getDeviceTopic(ctl), GetSensorNodeID(sensor))
+		h.cli.PublishHomie(sensorTopic+"/leak", strconv.FormatBool(sensor.IsWaterDetected()))
+		h.cli.PublishHomie(sensorTopic+"/low-bat", strconv.FormatBool(sensor.IsBatLow()))
+		h.cli.PublishHomie(sensorTopic+"/lost-signal", strconv.FormatBool(sensor.IsLostSignal()))
+	}
+}
+
+// PublishState publish the values of the controller and its sensors,
+// the whole device is published again when a sensor was paired or removed, or when it was lost
+func (h *Homie) PublishState(ctl *models.AkwatekCtl) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	published, ok := h.devices[GetDeviceID(ctl)]
+	if !ok || !slices.Equal(published.nodes, nodeIDs(ctl)) || published.state != STATE_READY {
+		h.publishDevice(ctl)
+		return
+	}
+	h.publishValues(ctl)
+}
+
+// SetLost set the device of an offline controller lost
+func (h *Homie) SetLost(ctl *models.AkwatekCtl) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if published, ok := h.devices[GetDeviceID(ctl)]; ok {
+		published.state = STATE_LOST
+	}
+	h.cli.PublishHomie(h.getDeviceTopic(ctl)+"/$state", STATE_LOST)
+}
+
+// Disconnect set every device disconnected, on shutdown
+func (h *Homie) Disconnect(ctls []*models.AkwatekCtl) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, ctl := range ctls {
+		h.cli.PublishHomie(h.getDeviceTopic(ctl)+"/$state", STATE_DISCONNECTED)
+	}
+}
+
+// WatchValve subscribe to the valve property, open or closed is given to the callback as OPEN or CLOSE
+func (h *Homie) WatchValve(ctl *models.AkwatekCtl, callback func(payload []byte) json.Marshaler) {
+	h.cli.WatchCommand(h.GetValveCommandTopic(ctl), func(payload []byte) json.Marshaler {
+		switch strings.ToLower(strings.TrimSpace(string(payload))) {
+		case "open":
+			return callback([]byte("OPEN"))
+		case "closed":
+			return callback([]byte("CLOSE"))
+		}
+		log.Warn().Msgf("invalid Homie valve value %q for %s, expected open or closed", payload, ctl.MAC)
+		return callback(payload)
+	})
+}
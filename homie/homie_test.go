@@ -0,0 +1,155 @@
+package homie
+
+import (
+	"akwatek-mqtt-bridge/models"
+	"akwatek-mqtt-bridge/utils"
+	"encoding/json"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakePublisher keep the last value of every topic, "" once cleared, and the watched commands
+type fakePublisher struct {
+	mu       sync.Mutex
+	values   map[string]string
+	states   []string
+	commands map[string]func(payload []byte) json.Marshaler
+}
+
+func newFakePublisher() *fakePublisher {
+	return &fakePublisher{
+		values:   map[string]string{},
+		commands: map[string]func(payload []byte) json.Marshaler{},
+	}
+}
+
+func (p *fakePublisher) PublishHomie(topic string, value string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.values[topic] = value
+	if strings.HasSuffix(topic, "/$state") {
+		p.states = append(p.states, value)
+	}
+}
+
+func (p *fakePublisher) ClearRetained(topic string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.values[topic] = ""
+}
+
+func (p *fakePublisher) WatchCommand(topicID string, callback func(payload []byte) json.Marshaler) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.commands[topicID] = callback
+}
+
+// node return the values published under a node, cleared ones included
+func (p *fakePublisher) node(h *Homie, ctl *models.AkwatekCtl, node string) map[string]string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	prefix := h.getDeviceTopic(ctl) + "/" + node + "/"
+	values := map[string]string{}
+	for topic, value := range p.values {
+		if strings.HasPrefix(topic, prefix) {
+			values[strings.TrimPrefix(topic, prefix)] = value
+		}
+	}
+	return values
+}
+
+func newCtl(t *testing.T, zones string) *models.AkwatekCtl {
+	t.Helper()
+	mac, err := net.ParseMAC("bc:ff:4d:00:00:01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctl, err := models.NewAkwatekCtl(&models.ReqItekV1{MacAddress: mac, ID: "1.0", CtlStatus: "18041", Zone01To25: zones})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ctl
+}
+
+func parse(t *testing.T, ctl *models.AkwatekCtl, zones string) {
+	t.Helper()
+	request := ctl.GetLastRequest()
+	request.Zone01To25 = zones
+	if err := ctl.Parse(&request); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNodeLifecycle(t *testing.T) {
+	publisher := newFakePublisher()
+	h := NewHomie(&utils.Config{HomieBaseTopic: "homie"}, publisher)
+	ctl := newCtl(t, "11")
+	h.PublishDevice(ctl)
+	deviceTopic := h.getDeviceTopic(ctl)
+	if nodes := publisher.values[deviceTopic+"/$nodes"]; nodes != "controller,sensor-1,sensor-2" {
+		t.Errorf("got nodes %q", nodes)
+	}
+
+	// a removed sensor has every attribute and value of its node cleared
+	parse(t, ctl, "10")
+	h.PublishState(ctl)
+	if nodes := publisher.values[deviceTopic+"/$nodes"]; nodes != "controller,sensor-1" {
+		t.Errorf("got nodes %q after the removal", nodes)
+	}
+	removed := publisher.node(h, ctl, "sensor-2")
+	for _, attribute := range []string{"$name", "$type", "$properties", "leak", "leak/$name", "leak/$datatype", "low-bat", "lost-signal"} {
+		if value, ok := removed[attribute]; !ok || value != "" {
+			t.Errorf("attribute %s of the removed node not cleared", attribute)
+		}
+	}
+	if value := publisher.node(h, ctl, "sensor-1")["leak"]; value != "false" {
+		t.Errorf("got leak %q for sensor 1, expected false", value)
+	}
+
+	// a paired sensor has its node published again
+	parse(t, ctl, "11")
+	h.PublishState(ctl)
+	if nodes := publisher.values[deviceTopic+"/$nodes"]; nodes != "controller,sensor-1,sensor-2" {
+		t.Errorf("got nodes %q after the pairing", nodes)
+	}
+	added := publisher.node(h, ctl, "sensor-2")
+	if added["$name"] != "Zone 2" || added["$properties"] != "leak,low-bat,lost-signal" || added["leak"] != "false" {
+		t.Errorf("unexpected node %v", added)
+	}
+	if states := strings.Join(publisher.states, ","); states != "init,ready,init,ready,init,ready" {
+		t.Errorf("got states %s", states)
+	}
+}
+
+func TestWatchValve(t *testing.T) {
+	publisher := newFakePublisher()
+	h := NewHomie(&utils.Config{HomieBaseTopic: "homie"}, publisher)
+	ctl := newCtl(t, "1")
+	received := make([]string, 0)
+	h.WatchValve(ctl, func(payload []byte) json.Marshaler {
+		received = append(received, string(payload))
+		return nil
+	})
+	command := publisher.commands[h.GetValveCommandTopic(ctl)]
+	if command == nil {
+		t.Fatalf("%s not watched", h.GetValveCommandTopic(ctl))
+	}
+	tests := []struct {
+		value   string
+		command string
+	}{
+		{"open", "OPEN"},
+		{"closed", "CLOSE"},
+		{" Closed\n", "CLOSE"},
+		// invalid, given as is to be refused by the callback
+		{"opening", "opening"},
+	}
+	for _, test := range tests {
+		command([]byte(test.value))
+		if got := received[len(received)-1]; got != test.command {
+			t.Errorf("got %q for %q, expected %q", got, test.value, test.command)
+		}
+	}
+}
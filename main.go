@@ -1,80 +1,140 @@
 package main
 
 import (
-	"akwatek-mqtt-bridge/models"
+	"akwatek-mqtt-bridge/bridge"
+	"akwatek-mqtt-bridge/homie"
 	mqtt_client "akwatek-mqtt-bridge/mqtt-client"
+	"akwatek-mqtt-bridge/notify"
+	"akwatek-mqtt-bridge/passthrough"
+	"akwatek-mqtt-bridge/policy"
+	"akwatek-mqtt-bridge/scheduler"
+	"akwatek-mqtt-bridge/simulator"
+	"akwatek-mqtt-bridge/sink"
+	"akwatek-mqtt-bridge/store"
 	"akwatek-mqtt-bridge/utils"
 	"crypto/tls"
+	"flag"
 	"fmt"
 	"github.com/gin-gonic/gin"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 )
 
 func main() {
+	command := "serve"
+	args := os.Args[1:]
+	if len(args) > 0 {
+		command, args = args[0], args[1:]
+	}
 
 	config := utils.GetConfig()
 	zerolog.SetGlobalLevel(config.LogLevel)
+
+	switch command {
+	case "serve":
+		serve(config)
+	case "replay":
+		replay(config, args)
+	case "simulate":
+		simulate(config, args)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q, expected serve, replay or simulate\n", command)
+		os.Exit(2)
+	}
+}
+
+func serve(config *utils.Config) {
 	cli := mqtt_client.NewMQTT(config)
 	router := gin.New()
 
-	ctlList := make(map[string]*models.AkwatekCtl)
+	registryStore, err := store.NewStore(config)
+	if err != nil {
+		panic(err)
+	}
+	defer registryStore.Close()
+
+	b := bridge.NewBridge(config, cli, registryStore)
+	setSinks(config, cli, b)
+	if config.Passthrough.Enabled {
+		log.Info().Msgf("Passthrough mode enabled, relaying to %s", config.Passthrough.URL)
+		b.SetPassthrough(passthrough.NewPassthrough(config))
+	}
+	if len(config.Policies) > 0 {
+		engine, err := policy.NewEngine(config.Policies)
+		if err != nil {
+			panic(err)
+		}
+		log.Info().Msgf("Valve shut-off policy enabled with %d rules", len(engine.Rules()))
+		b.SetPolicy(engine)
+	}
+	if len(config.Schedules) > 0 {
+		s, err := scheduler.NewScheduler(config.Schedules)
+		if err != nil {
+			panic(err)
+		}
+		log.Info().Msgf("Scheduler enabled with %d schedules", len(config.Schedules))
+		b.SetScheduler(s)
+	}
+	if config.CaptureFile != "" {
+		log.Info().Msgf("Capturing check-ins to %s", config.CaptureFile)
+		capture, err := bridge.NewCapture(config.CaptureFile)
+		if err != nil {
+			panic(err)
+		}
+		defer capture.Close()
+		b.SetCapture(capture)
+	}
+	if len(config.Notifications) > 0 {
+		notifier, err := notify.NewNotifier(config.Notifications, config.Store.DataDir)
+		if err != nil {
+			panic(err)
+		}
+		log.Info().Msgf("Webhook notifications enabled with %d webhooks, queued in %s", len(config.Notifications), config.Store.DataDir)
+		b.SetNotifier(notifier)
+	}
+	if config.HomieEnabled {
+		log.Info().Msgf("Homie output enabled on %s", config.HomieBaseTopic)
+		h := homie.NewHomie(config, cli)
+		b.SetHomie(h)
+		b.AddCommandSource(h)
+	}
+	b.Restore()
+	if config.HassDiscoveryEnabled {
+		b.WatchHassStatus()
+	}
+	go b.Watchdog()
+
+	// set the bridge offline on shutdown, the last will only cover an unexpected disconnection
+	go func() {
+		interrupt := make(chan os.Signal, 1)
+		signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+		<-interrupt
+		log.Info().Msg("Shutting down")
+		b.Wait()
+		b.Close()
+		cli.Close()
+		registryStore.Close()
+		os.Exit(0)
+	}()
+
 	router.POST("/collect2.php", func(c *gin.Context) {
-		var reqBodyItekV1 models.ReqBodyItekV1
-		if err := c.Bind(&reqBodyItekV1); err != nil {
+		rawBody, err := c.GetRawData()
+		if err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{})
 			return
 		}
-		itekv1 := reqBodyItekV1.ItekV1
-		// create new akwatek controller object if not present
-		if _, ok := ctlList[itekv1.GetIdentifier()]; !ok {
-			ctl, err := models.NewAkwatekCtl(&itekv1)
-			if err != nil {
-				c.JSON(http.StatusBadRequest, gin.H{})
-				return
-			}
-			ctlList[itekv1.GetIdentifier()] = ctl
-			go cli.WatchValve(ctl.GetMQTTSValveCommandTopic(config.MQTT.BaseTopic), ctl.ValveCallback())
-		} else { // if exist, update values of controller
-			if err := ctlList[itekv1.GetIdentifier()].Parse(&itekv1); err != nil {
-				c.JSON(http.StatusBadRequest, gin.H{})
-				return
-			}
+		res, err := b.CheckIn(rawBody, c.Request.Header)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{})
+			return
 		}
-
-		ctl := ctlList[itekv1.GetIdentifier()]
-
-		log.Debug().Msgf("%v", reqBodyItekV1.ItekV1)
-		log.Info().Msgf("%s -- %v", ctl, ctl.Sensors)
-		c.JSON(http.StatusOK, models.ResBodyItekV1{
-			ItekV1: models.ResItekV1{
-				Message: "OK",
-				Valve:   ctlList[itekv1.GetIdentifier()].GetValveAction(),
-			},
-		})
-
-		// Async mqtt publish
-		go func() {
-			if ctl.LastHassConfigPublished.Add(time.Hour).Before(time.Now()) {
-				PublishHassConfig(config, cli, ctl)
-				// delay before send state
-				time.Sleep(time.Second * 5)
-			}
-
-			cli.PublishAvailability(ctl.GetMQTTAvailabilityTopic(config.MQTT.BaseTopic))
-			cli.PublishState(ctl.GetMQTTStateTopic(config.MQTT.BaseTopic), ctl)
-			for _, sensor := range ctl.Sensors {
-				if !sensor.IsConfigured() {
-					continue
-				}
-				cli.PublishAvailability(sensor.GetMQTTAvailabilityTopic(config.MQTT.BaseTopic))
-				cli.PublishState(sensor.GetMQTTStateTopic(config.MQTT.BaseTopic), sensor)
-			}
-			// don't repeat valve action on the next call
-			ctlList[itekv1.GetIdentifier()].ResetValveAction()
-		}()
+		c.JSON(http.StatusOK, res)
 	})
 
 	// get our ca and server certificate
@@ -91,36 +151,107 @@ func main() {
 	router.RunListener(tlsServer)
 }
 
-func PublishHassConfig(config *utils.Config, cli *mqtt_client.Client, ctl *models.AkwatekCtl) {
-	log.Info().Msgf("Publishing homeassistant mqtt config")
-	cli.PublishState(
-		ctl.GetMQTTValveHassConfigTopic(config.HassDiscoveryTopic),
-		ctl.GetMQTTValveHassConfig(config.MQTT.BaseTopic))
-	// delay for home-assistant on the first time creation
-	time.Sleep(time.Second * 5)
-	cli.PublishState(
-		ctl.GetMQTTAlarmHassConfigTopic(config.HassDiscoveryTopic),
-		ctl.GetMQTTAlarmHassConfig(config.MQTT.BaseTopic))
-	cli.PublishState(
-		ctl.GetMQTTPowerHassConfigTopic(config.HassDiscoveryTopic),
-		ctl.GetMQTTPowerHassConfig(config.MQTT.BaseTopic))
-	cli.PublishState(
-		ctl.GetMQTTBatteryHassConfigTopic(config.HassDiscoveryTopic),
-		ctl.GetMQTTBatteryHassConfig(config.MQTT.BaseTopic))
-
-	for _, sensor := range ctl.Sensors {
-		if !sensor.IsConfigured() {
-			continue
+// setSinks give the state of the controllers to the configured sinks, the valve commands are received from MQTT
+// only with a mqtt sink, every mqtt sink share the same command topic so it's subscribed once
+func setSinks(config *utils.Config, cli *mqtt_client.Client, b *bridge.Bridge) {
+	sinks, err := sink.NewSinks(config, cli)
+	if err != nil {
+		panic(err)
+	}
+	var commandSource *sink.MQTT
+	for _, s := range sinks {
+		log.Info().Msgf("Publishing the controllers state to sink %s", s.Name())
+		if mqttSink, ok := s.(*sink.MQTT); ok && commandSource == nil {
+			commandSource = mqttSink
+		}
+	}
+	b.SetSinks(sinks)
+	if commandSource == nil {
+		log.Warn().Msgf("No %s sink, the valve commands aren't received on %s", sink.SINK_MQTT, config.MQTT.BaseTopic)
+		return
+	}
+	b.AddCommandSource(commandSource)
+}
+
+// replay feed a capture file to the bridge, without passthrough and without touching the store
+func replay(config *utils.Config, args []string) {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	speed := flags.Float64("speed", 1, "replay speed factor, 0 to replay without delay")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s replay [-speed factor] <capture.jsonl>\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	cli := mqtt_client.NewMQTT(config)
+	b := bridge.NewBridge(config, cli, &store.NoopStore{})
+	setSinks(config, cli, b)
+	defer b.Close()
+	if err := b.Replay(flags.Arg(0), *speed); err != nil {
+		log.Fatal().Err(err).Msgf("failed to replay %s", flags.Arg(0))
+	}
+	b.Wait()
+}
+
+type eventsFlag []*simulator.Event
+
+func (e *eventsFlag) String() string {
+	return fmt.Sprintf("%v", *e)
+}
+
+func (e *eventsFlag) Set(value string) error {
+	event, err := simulator.ParseEvent(value)
+	if err != nil {
+		return err
+	}
+	*e = append(*e, event)
+	return nil
+}
+
+// simulate act like one or more controllers calling the bridge
+func simulate(config *utils.Config, args []string) {
+	flags := flag.NewFlagSet("simulate", flag.ExitOnError)
+	url := flags.String("url", fmt.Sprintf("https://127.0.0.1:%d/collect2.php", config.TLSPort), "url of the bridge")
+	interval := flags.Duration("interval", time.Minute, "delay between check-ins")
+	firstMAC := flags.String("mac", "BC:FF:4D:00:00:01", "MAC address of the first controller, incremented for the next ones")
+	count := flags.Int("count", 1, "number of controllers")
+	status := flags.String("status", "18041", "initial Cont_status")
+	zones := flags.String("zones", "111", "initial zones, from zone 1 to 100, padded with 0")
+	var events eventsFlag
+	flags.Var(&events, "event", "scripted event <after>:<kind>[:<zone>], kind is leak, dry, lowbat, bat, lost, signal, power-off, power-on or reset (repeatable)")
+	flags.Parse(args)
+
+	mac, err := net.ParseMAC(*firstMAC)
+	if err != nil {
+		log.Fatal().Err(err).Msgf("invalid MAC address %s", *firstMAC)
+	}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	for i := 0; i < *count; i++ {
+		ctlMAC := make(net.HardwareAddr, len(mac))
+		copy(ctlMAC, mac)
+		ctlMAC[len(ctlMAC)-1] += byte(i)
+		ctl, err := simulator.NewController(ctlMAC, *status, *zones, append([]*simulator.Event{}, events...))
+		if err != nil {
+			log.Fatal().Err(err).Msg("invalid simulated controller")
 		}
-		cli.PublishState(
-			sensor.GetMQTTBatHassConfigTopic(config.HassDiscoveryTopic),
-			sensor.GetMQTTBatHassConfig(config.MQTT.BaseTopic))
-		cli.PublishState(
-			sensor.GetMQTTLeakHassConfigTopic(config.HassDiscoveryTopic),
-			sensor.GetMQTTLeakHassConfig(config.MQTT.BaseTopic))
-		cli.PublishState(
-			sensor.GetMQTTSignalHassConfigTopic(config.HassDiscoveryTopic),
-			sensor.GetMQTTSignalHassConfig(config.MQTT.BaseTopic))
-	}
-	ctl.LastHassConfigPublished = time.Now()
+		log.Info().Msgf("Simulating controller %s on %s every %s", ctlMAC, *url, *interval)
+		go func() {
+			ctl.Run(*url, *interval, stop)
+			done <- struct{}{}
+		}()
+	}
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	<-interrupt
+	close(stop)
+	for i := 0; i < *count; i++ {
+		<-done
+	}
 }
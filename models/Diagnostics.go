@@ -0,0 +1,90 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// CtlDiagnostics is published for the diagnostic entities of the controller,
+// CheckInInterval is the delay in seconds between the last two check-ins and Requests the check-ins received by the bridge
+type CtlDiagnostics struct {
+	LastCheckIn     time.Time         `json:"last_checkin"`
+	CheckInInterval float64           `json:"checkin_interval"`
+	Status          string            `json:"status"`
+	Zones           string            `json:"zones"`
+	RawZones        map[string]string `json:"raw_zones"`
+	ID              string            `json:"id"`
+	Requests        uint64            `json:"requests"`
+}
+
+func (a *AkwatekCtl) GetDiagnostics() *CtlDiagnostics {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	request := a.lastRequest
+	return &CtlDiagnostics{
+		LastCheckIn:     a.lastSeen,
+		CheckInInterval: a.checkInInterval.Seconds(),
+		Status:          request.CtlStatus,
+		Zones:           request.Zone01To25 + request.Zone26To50 + request.Zone51To75 + request.Zone76To100,
+		RawZones: map[string]string{
+			"zone01-25":  request.Zone01To25,
+			"zone26-50":  request.Zone26To50,
+			"zone51-75":  request.Zone51To75,
+			"zone76-100": request.Zone76To100,
+		},
+		ID:       request.ID,
+		Requests: a.requests,
+	}
+}
+
+func (d *CtlDiagnostics) MarshalJSON() ([]byte, error) {
+	type Alias CtlDiagnostics
+	alias := (*Alias)(d)
+
+	return json.Marshal(&struct {
+		*Alias
+	}{
+		Alias: alias,
+	})
+}
+
+func (a *AkwatekCtl) GetMQTTDiagnosticsTopic(baseTopic string) string {
+	return fmt.Sprintf("%s/%s/controller/diagnostics", baseTopic, a.GetIdentifier())
+}
+
+// GetMQTTDiagnosticsHassEntities return the diagnostic entities of the controller,
+// they are only unavailable with the bridge so the last check-in of an offline controller stays visible
+func (a *AkwatekCtl) GetMQTTDiagnosticsHassEntities(baseTopic string) []*HassEntity {
+	diagnostic := func(key string, name string, valueTemplate string) *HassDiscoveryPayload {
+		return &HassDiscoveryPayload{
+			Name:           name,
+			Availability:   []HassAvailabilityPayload{{Topic: GetMQTTBridgeAvailabilityTopic(baseTopic)}},
+			StateTopic:     a.GetMQTTDiagnosticsTopic(baseTopic),
+			UniqueId:       fmt.Sprintf("%s_%s", a.GetMQTTHassNodeId(), key),
+			ValueTemplate:  valueTemplate,
+			EntityCategory: "diagnostic",
+			Device:         a.GetMQTTHassDevice(),
+		}
+	}
+	lastCheckIn := diagnostic("last_checkin", "last check-in", "{{ value_json.last_checkin }}")
+	lastCheckIn.DeviceClass = "timestamp"
+	checkInInterval := diagnostic("checkin_interval", "check-in interval", "{{ value_json.checkin_interval }}")
+	checkInInterval.DeviceClass = "duration"
+	checkInInterval.UnitOfMeasurement = "s"
+	checkInInterval.StateClass = "measurement"
+	zones := diagnostic("zones", "zones", "{{ value_json.zones }}")
+	zones.JsonAttributesTopic = a.GetMQTTDiagnosticsTopic(baseTopic)
+	zones.JsonAttributesTemplate = "{{ value_json.raw_zones | tojson }}"
+	requests := diagnostic("requests", "requests", "{{ value_json.requests }}")
+	requests.StateClass = "total_increasing"
+
+	return []*HassEntity{
+		{Component: "sensor", ObjectID: "last_checkin", Config: lastCheckIn},
+		{Component: "sensor", ObjectID: "checkin_interval", Config: checkInInterval},
+		{Component: "sensor", ObjectID: "status", Config: diagnostic("status", "status", "{{ value_json.status }}")},
+		{Component: "sensor", ObjectID: "zones", Config: zones},
+		{Component: "sensor", ObjectID: "id", Config: diagnostic("id", "ID", "{{ value_json.id }}")},
+		{Component: "sensor", ObjectID: "requests", Config: requests},
+	}
+}
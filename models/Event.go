@@ -0,0 +1,157 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+)
+
+const (
+	EVENT_CONTROLLER_OFFLINE string = "controller_offline"
+	EVENT_CONTROLLER_ONLINE  string = "controller_online"
+	EVENT_SENSOR_PAIRED      string = "sensor_paired"
+	EVENT_SENSOR_REMOVED     string = "sensor_removed"
+	EVENT_POLICY_TRIGGERED   string = "policy_triggered"
+	EVENT_DRY_RUN_VALVE      string = "dry_run_valve"
+	EVENT_LEAK_STARTED       string = "leak_started"
+	EVENT_LEAK_CLEARED       string = "leak_cleared"
+	EVENT_ALARM_STARTED      string = "alarm_started"
+	EVENT_ALARM_CLEARED      string = "alarm_cleared"
+	EVENT_POWER_LOST         string = "power_lost"
+	EVENT_POWER_RESTORED     string = "power_restored"
+	EVENT_BATTERY_LOW        string = "battery_low"
+	EVENT_BATTERY_OK         string = "battery_ok"
+	EVENT_SIGNAL_LOST        string = "signal_lost"
+	EVENT_SIGNAL_RESTORED    string = "signal_restored"
+)
+
+// EVENT_TYPES is every type of event
+var EVENT_TYPES = []string{
+	EVENT_CONTROLLER_OFFLINE, EVENT_CONTROLLER_ONLINE, EVENT_SENSOR_PAIRED, EVENT_SENSOR_REMOVED,
+	EVENT_POLICY_TRIGGERED, EVENT_DRY_RUN_VALVE, EVENT_LEAK_STARTED, EVENT_LEAK_CLEARED,
+	EVENT_ALARM_STARTED, EVENT_ALARM_CLEARED, EVENT_POWER_LOST, EVENT_POWER_RESTORED,
+	EVENT_BATTERY_LOW, EVENT_BATTERY_OK, EVENT_SIGNAL_LOST, EVENT_SIGNAL_RESTORED,
+}
+
+// Event is a diagnostic event published on the controller event topic
+type Event struct {
+	Type       string                 `json:"event"`
+	Time       time.Time              `json:"time"`
+	Controller string                 `json:"controller"`
+	Sensor     int                    `json:"sensor,omitempty"`
+	Message    string                 `json:"message"`
+	Attributes map[string]interface{} `json:"attributes,omitempty"`
+}
+
+func NewEvent(ctl *AkwatekCtl, eventType string, message string) *Event {
+	return &Event{
+		Type:       eventType,
+		Time:       time.Now(),
+		Controller: ctl.MAC.String(),
+		Message:    message,
+		Attributes: map[string]interface{}{},
+	}
+}
+
+func NewSensorEvent(sensor *LeakoSensor, eventType string, message string) *Event {
+	event := NewEvent(sensor.Ctl, eventType, message)
+	event.Sensor = sensor.ID
+	return event
+}
+
+// transition is a state of a controller or of a sensor, with the event of its start and of its end
+type transition struct {
+	previous       bool
+	current        bool
+	startedType    string
+	clearedType    string
+	startedMessage string
+	clearedMessage string
+}
+
+func (t *transition) eventType() string {
+	if t.current {
+		return t.startedType
+	}
+	return t.clearedType
+}
+
+func (t *transition) message(name string) string {
+	if t.current {
+		return fmt.Sprintf(t.startedMessage, name)
+	}
+	return fmt.Sprintf(t.clearedMessage, name)
+}
+
+// GetTransitionEvents return an event for every alarm, power and sensor state changed by the last check-in,
+// a new controller or a new sensor is compared to a normal state so only its problems are reported
+func (a *AkwatekCtl) GetTransitionEvents() []*Event {
+	a.mu.RLock()
+	previousValue, value := a.previousValue, a.value
+	previousSensors, sensors := a.previousSensors, a.sensors
+	a.mu.RUnlock()
+
+	name := a.GetName()
+	events := make([]*Event, 0)
+	for _, t := range []*transition{
+		{previousValue != nil && hasAlarm(previousValue), hasAlarm(value),
+			EVENT_ALARM_STARTED, EVENT_ALARM_CLEARED, "alarm on controller %s", "alarm cleared on controller %s"},
+		{previousValue != nil && !hasPowerLine(previousValue), !hasPowerLine(value),
+			EVENT_POWER_LOST, EVENT_POWER_RESTORED, "mains power lost on controller %s", "mains power restored on controller %s"},
+	} {
+		if t.previous == t.current {
+			continue
+		}
+		event := NewEvent(a, t.eventType(), t.message(name))
+		event.Attributes["controller_name"] = name
+		events = append(events, event)
+	}
+
+	ids := make([]int, 0, len(sensors))
+	for id := range sensors {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		sensor := sensors[id]
+		if sensor.IsRemoved() || !sensor.IsConfigured() || sensor.IsIgnored() {
+			continue
+		}
+		previous, known := previousSensors[id]
+		if !known || previous.IsRemoved() {
+			previous = &LeakoSensor{ID: id, Ctl: a}
+		}
+		for _, t := range []*transition{
+			{previous.IsWaterDetected(), sensor.IsWaterDetected(),
+				EVENT_LEAK_STARTED, EVENT_LEAK_CLEARED, "leak detected by sensor %s", "leak cleared on sensor %s"},
+			{previous.IsBatLow(), sensor.IsBatLow(),
+				EVENT_BATTERY_LOW, EVENT_BATTERY_OK, "low battery on sensor %s", "battery replaced on sensor %s"},
+			{previous.IsLostSignal(), sensor.IsLostSignal(),
+				EVENT_SIGNAL_LOST, EVENT_SIGNAL_RESTORED, "signal lost with sensor %s", "signal restored with sensor %s"},
+		} {
+			if t.previous == t.current {
+				continue
+			}
+			event := NewSensorEvent(sensor, t.eventType(), t.message(sensor.GetName()))
+			event.Attributes["controller_name"] = name
+			event.Attributes["zone"] = sensor.GetName()
+			if area := a.GetZone(id).Area; area != "" {
+				event.Attributes["area"] = area
+			}
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+func (e *Event) MarshalJSON() ([]byte, error) {
+	type Alias Event
+	alias := (*Alias)(e)
+
+	return json.Marshal(&struct {
+		*Alias
+	}{
+		Alias: alias,
+	})
+}
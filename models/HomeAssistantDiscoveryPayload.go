@@ -1,31 +1,52 @@
 package models
 
-import "encoding/json"
+import (
+	"encoding/json"
+	"fmt"
+)
 
+const HASS_ORIGIN string = "akwatek-mqtt-bridge"
+
+// HassDeviceDiscoveryPayload is the device registry entry, Connections are [type, value] pairs like ["mac", "bc:ff:4d:00:00:01"]
 type HassDeviceDiscoveryPayload struct {
-	Identifiers  []string `json:"identifiers"`
-	Name         string   `json:"name"`
-	Manufacturer string   `json:"manufacturer,omitempty"`
-	Model        string   `json:"model,omitempty"`
-	SerialNumber string   `json:"serial_number,omitempty"`
-	HwVersion    string   `json:"hw_version,omitempty"`
-	SwVersion    string   `json:"sw_version,omitempty"`
+	Identifiers      []string    `json:"identifiers"`
+	Connections      [][2]string `json:"connections,omitempty"`
+	Name             string      `json:"name"`
+	Manufacturer     string      `json:"manufacturer,omitempty"`
+	Model            string      `json:"model,omitempty"`
+	SerialNumber     string      `json:"serial_number,omitempty"`
+	HwVersion        string      `json:"hw_version,omitempty"`
+	SwVersion        string      `json:"sw_version,omitempty"`
+	SuggestedArea    string      `json:"suggested_area,omitempty"`
+	ViaDevice        string      `json:"via_device,omitempty"`
+	ConfigurationURL string      `json:"configuration_url,omitempty"`
+}
+
+type HassAvailabilityPayload struct {
+	Topic               string `json:"topic"`
+	PayloadAvailable    string `json:"payload_available,omitempty"`
+	PayloadNotAvailable string `json:"payload_not_available,omitempty"`
 }
 
 type HassDiscoveryPayload struct {
-	Name              string                     `json:"name"`
-	DeviceClass       string                     `json:"device_class"`
-	StateTopic        string                     `json:"state_topic"`
-	CommandTopic      string                     `json:"command_topic,omitempty"`
-	AvailabilityTopic string                     `json:"availability_topic,omitempty"`
-	UniqueId          string                     `json:"unique_id"`
-	UnitOfMeasurement string                     `json:"unit_of_measurement,omitempty"`
-	ValueTemplate     string                     `json:"value_template,omitempty"`
-	PayloadOff        string                     `json:"payload_off,omitempty"`
-	PayloadOn         string                     `json:"payload_on,omitempty"`
-	ReportsPosition   bool                       `json:"reports_position,omitempty"`
-	Optimistic        bool                       `json:"optimistic,omitempty"`
-	Device            HassDeviceDiscoveryPayload `json:"device"`
+	Name                   string                     `json:"name"`
+	DeviceClass            string                     `json:"device_class,omitempty"`
+	StateTopic             string                     `json:"state_topic"`
+	CommandTopic           string                     `json:"command_topic,omitempty"`
+	Availability           []HassAvailabilityPayload  `json:"availability,omitempty"`
+	AvailabilityMode       string                     `json:"availability_mode,omitempty"`
+	UniqueId               string                     `json:"unique_id"`
+	UnitOfMeasurement      string                     `json:"unit_of_measurement,omitempty"`
+	ValueTemplate          string                     `json:"value_template,omitempty"`
+	PayloadOff             string                     `json:"payload_off,omitempty"`
+	PayloadOn              string                     `json:"payload_on,omitempty"`
+	ReportsPosition        bool                       `json:"reports_position,omitempty"`
+	Optimistic             bool                       `json:"optimistic,omitempty"`
+	EntityCategory         string                     `json:"entity_category,omitempty"`
+	StateClass             string                     `json:"state_class,omitempty"`
+	JsonAttributesTopic    string                     `json:"json_attributes_topic,omitempty"`
+	JsonAttributesTemplate string                     `json:"json_attributes_template,omitempty"`
+	Device                 HassDeviceDiscoveryPayload `json:"device"`
 }
 
 func (h *HassDiscoveryPayload) MarshalJSON() ([]byte, error) {
@@ -38,3 +59,117 @@ func (h *HassDiscoveryPayload) MarshalJSON() ([]byte, error) {
 		Alias: alias,
 	})
 }
+
+// GetMQTTBridgeAvailabilityTopic is the availability of the bridge itself, set offline by the MQTT last will
+func GetMQTTBridgeAvailabilityTopic(baseTopic string) string {
+	return fmt.Sprintf("%s/bridge/availability", baseTopic)
+}
+
+// hassAvailability make the entity unavailable when either the bridge or the device is gone
+func hassAvailability(baseTopic string, availabilityTopic string) []HassAvailabilityPayload {
+	return []HassAvailabilityPayload{
+		{Topic: GetMQTTBridgeAvailabilityTopic(baseTopic)},
+		{Topic: availabilityTopic},
+	}
+}
+
+// HassEntity is an entity of a device, published on its own discovery topic
+// or as a component of the device discovery, Component is its platform like binary_sensor
+type HassEntity struct {
+	Component string
+	ObjectID  string
+	Config    *HassDiscoveryPayload
+}
+
+// GetTopic return the discovery topic of the entity alone, nodeID is the controller one
+func (e *HassEntity) GetTopic(hassPrefix string, nodeID string) string {
+	return fmt.Sprintf("%s/%s/%s/%s/config", hassPrefix, e.Component, nodeID, e.ObjectID)
+}
+
+func GetMQTTHassDeviceConfigTopic(hassPrefix string, nodeID string) string {
+	return fmt.Sprintf("%s/device/%s/config", hassPrefix, nodeID)
+}
+
+type HassOriginPayload struct {
+	Name string `json:"name"`
+}
+
+// HassComponentPayload is an entity of the device discovery, a component without config is removed from Home Assistant
+type HassComponentPayload struct {
+	Platform string
+	Config   *HassDiscoveryPayload
+}
+
+func (c *HassComponentPayload) MarshalJSON() ([]byte, error) {
+	if c.Config == nil {
+		return json.Marshal(map[string]string{"platform": c.Platform})
+	}
+	type Alias HassDiscoveryPayload
+	alias := (*Alias)(c.Config)
+
+	// the device is set once for every component
+	return json.Marshal(&struct {
+		*Alias
+		Platform string                      `json:"platform"`
+		Device   *HassDeviceDiscoveryPayload `json:"device,omitempty"`
+	}{
+		Alias:    alias,
+		Platform: c.Platform,
+	})
+}
+
+// HassDeviceDiscoveryConfig is the single discovery message of a device and all its entities
+type HassDeviceDiscoveryConfig struct {
+	Device     HassDeviceDiscoveryPayload       `json:"device"`
+	Origin     HassOriginPayload                `json:"origin"`
+	Components map[string]*HassComponentPayload `json:"components"`
+}
+
+func NewHassDeviceDiscoveryConfig(device HassDeviceDiscoveryPayload) *HassDeviceDiscoveryConfig {
+	return &HassDeviceDiscoveryConfig{
+		Device:     device,
+		Origin:     HassOriginPayload{Name: HASS_ORIGIN},
+		Components: map[string]*HassComponentPayload{},
+	}
+}
+
+func (d *HassDeviceDiscoveryConfig) Add(entities ...*HassEntity) {
+	for _, entity := range entities {
+		d.Components[entity.ObjectID] = &HassComponentPayload{Platform: entity.Component, Config: entity.Config}
+	}
+}
+
+// Remove keep only the platform of the entities, so Home Assistant remove them
+func (d *HassDeviceDiscoveryConfig) Remove(entities ...*HassEntity) {
+	for _, entity := range entities {
+		d.Components[entity.ObjectID] = &HassComponentPayload{Platform: entity.Component}
+	}
+}
+
+func (d *HassDeviceDiscoveryConfig) MarshalJSON() ([]byte, error) {
+	type Alias HassDeviceDiscoveryConfig
+	alias := (*Alias)(d)
+
+	return json.Marshal(&struct {
+		*Alias
+	}{
+		Alias: alias,
+	})
+}
+
+// HassMigrateDiscovery is published on the discovery topics of one mode before switching to the other,
+// Home Assistant then keep the entities and their history
+type HassMigrateDiscovery struct {
+	MigrateDiscovery bool `json:"migrate_discovery"`
+}
+
+func (m *HassMigrateDiscovery) MarshalJSON() ([]byte, error) {
+	type Alias HassMigrateDiscovery
+	alias := (*Alias)(m)
+
+	return json.Marshal(&struct {
+		*Alias
+	}{
+		Alias: alias,
+	})
+}
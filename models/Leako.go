@@ -1,11 +1,17 @@
 package models
 
 import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"net"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -15,29 +21,133 @@ const (
 	VALVE_ACTION_OPEN   ValveAction = "1"
 	VALVE_ACTION_CLOSE  ValveAction = "0"
 	MANUFACTURER        string      = "AKWA Technologies"
+	CTL_MODEL           string      = "Leako controller"
+	SENSOR_MODEL        string      = "Leako sensor"
 	MANUFACTURER_PREFIX string      = "akwatek"
 )
 
+// AkwatekCtl is shared between the http handler, the mqtt callbacks and the publishers,
+// every mutable field is guarded by mu. value and sensors are replaced, never modified in place.
 type AkwatekCtl struct {
-	MAC                     net.HardwareAddr     `json:"-"`
-	Value                   []byte               `json:"-"`
-	Sensors                 map[int]*LeakoSensor `json:"-"`
-	valveAction             *ValveAction         `json:"-"`
-	LastHassConfigPublished time.Time            `json:"-"`
+	MAC                     net.HardwareAddr `json:"-"`
+	mu                      sync.RWMutex
+	value                   []byte
+	sensors                 map[int]*LeakoSensor
+	previousValue           []byte
+	previousSensors         map[int]*LeakoSensor
+	lastRequest             ReqItekV1
+	lastSeen                time.Time
+	checkInInterval         time.Duration
+	requests                uint64
+	offline                 bool
+	valveCommand            *ValveCommand
+	valveCommandHistory     ValveCommandHistory
+	disabledSchedules       []string
+	scheduleStates          map[string]ScheduleState
+	override                *ValveOverride
+	dryRun                  bool
+	simulatedValveOpen      *bool
+	metadata                *CtlMetadata
+	lastHassConfigPublished time.Time
+}
+
+// CtlMetadata is the Home Assistant device registry information of a controller and of its zones,
+// with SensorDevices every sensor is its own device connected through the controller
+type CtlMetadata struct {
+	Name             string
+	Area             string
+	ConfigurationURL string
+	SensorDevices    bool
+	Zones            map[int]*ZoneMetadata
+}
+
+// ZoneMetadata is the friendly name and the Home Assistant area of the sensor of a zone,
+// an ignored zone isn't published
+type ZoneMetadata struct {
+	Name   string
+	Area   string
+	Ignore bool
+}
+
+// AkwatekCtlSnapshot is the persisted state of a controller,
+// RemovedSensors are not in the request anymore but their removal isn't published yet
+type AkwatekCtlSnapshot struct {
+	Request                 ReqItekV1                `json:"request"`
+	LastSeen                time.Time                `json:"last_seen"`
+	LastHassConfigPublished time.Time                `json:"last_hass_config_published"`
+	ValveCommand            *ValveCommand            `json:"valve_command,omitempty"`
+	ValveCommandHistory     ValveCommandHistory      `json:"valve_command_history,omitempty"`
+	DisabledSchedules       []string                 `json:"disabled_schedules,omitempty"`
+	ScheduleStates          map[string]ScheduleState `json:"schedule_states,omitempty"`
+	Requests                uint64                   `json:"requests,omitempty"`
+	RemovedSensors          map[int]time.Time        `json:"removed_sensors,omitempty"`
 }
 
 func NewAkwatekCtl(v1 *ReqItekV1) (*AkwatekCtl, error) {
 	akwatekCtl := AkwatekCtl{
 		MAC:                     v1.MacAddress,
-		Sensors:                 map[int]*LeakoSensor{},
-		LastHassConfigPublished: time.UnixMicro(0),
+		sensors:                 map[int]*LeakoSensor{},
+		metadata:                &CtlMetadata{},
+		lastHassConfigPublished: time.UnixMicro(0),
 	}
 	if err := akwatekCtl.Parse(v1); err != nil {
 		return nil, err
 	}
+	// the sensors of a new controller are not newly paired, they are part of its discovery
+	for _, sensor := range akwatekCtl.sensors {
+		sensor.JustPaired = false
+	}
 	return &akwatekCtl, nil
 }
 
+func NewAkwatekCtlFromSnapshot(snapshot *AkwatekCtlSnapshot) (*AkwatekCtl, error) {
+	akwatekCtl, err := NewAkwatekCtl(&snapshot.Request)
+	if err != nil {
+		return nil, err
+	}
+	akwatekCtl.lastSeen = snapshot.LastSeen
+	akwatekCtl.lastHassConfigPublished = snapshot.LastHassConfigPublished
+	akwatekCtl.valveCommand = snapshot.ValveCommand
+	akwatekCtl.valveCommandHistory = snapshot.ValveCommandHistory
+	akwatekCtl.disabledSchedules = snapshot.DisabledSchedules
+	akwatekCtl.scheduleStates = snapshot.ScheduleStates
+	akwatekCtl.requests = snapshot.Requests
+	for id, removedAt := range snapshot.RemovedSensors {
+		if _, ok := akwatekCtl.sensors[id]; ok {
+			continue
+		}
+		akwatekCtl.sensors[id] = &LeakoSensor{
+			ID:        id,
+			Value:     0b0001,
+			Ctl:       akwatekCtl,
+			RemovedAt: removedAt,
+		}
+	}
+	return akwatekCtl, nil
+}
+
+func (a *AkwatekCtl) Snapshot() *AkwatekCtlSnapshot {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	snapshot := &AkwatekCtlSnapshot{
+		Request:                 a.lastRequest,
+		LastSeen:                a.lastSeen,
+		LastHassConfigPublished: a.lastHassConfigPublished,
+		ValveCommand:            a.valveCommand,
+		ValveCommandHistory:     a.valveCommandHistory,
+		DisabledSchedules:       a.disabledSchedules,
+		ScheduleStates:          a.scheduleStates,
+		Requests:                a.requests,
+		RemovedSensors:          map[int]time.Time{},
+	}
+	for id, sensor := range a.sensors {
+		if sensor.IsRemoved() {
+			snapshot.RemovedSensors[id] = sensor.RemovedAt
+		}
+	}
+	return snapshot
+}
+
 func (a *AkwatekCtl) Parse(v1 *ReqItekV1) error {
 	rawHex := make([]byte, 0)
 	for _, digit := range []byte(v1.CtlStatus) {
@@ -47,58 +157,241 @@ func (a *AkwatekCtl) Parse(v1 *ReqItekV1) error {
 		}
 		rawHex = append(rawHex, uint8(rawDecode))
 	}
+	if len(rawHex) < 5 {
+		return fmt.Errorf("invalid controller status %q", v1.CtlStatus)
+	}
 
-	if err := a.ParseSensors(v1); err != nil {
+	// the lock is held from the sensors parsing to the assignment, so two check-ins of the controller
+	// can't both start from the same sensors and lose an update or compare with the wrong previous check-in
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	sensors, err := a.parseSensors(v1)
+	if err != nil {
 		return err
 	}
-
-	a.Value = rawHex
+	// in dry-run a valve moved by the controller itself, like on a leak, wins over the simulated one
+	if a.value != nil && a.value[4]&0b1 != rawHex[4]&0b1 {
+		a.simulatedValveOpen = nil
+	}
+	// the previous check-in is kept to find the states that changed
+	a.previousValue = a.value
+	a.previousSensors = a.sensors
+	a.value = rawHex
+	a.sensors = sensors
+	a.lastRequest = *v1
+	now := time.Now()
+	if !a.lastSeen.IsZero() {
+		a.checkInInterval = now.Sub(a.lastSeen)
+	}
+	a.lastSeen = now
+	a.requests++
 	return nil
 }
 
-func (a *AkwatekCtl) ParseSensors(v1 *ReqItekV1) error {
+// parseSensors return a new sensors map, updated with the zones of the request, mu must be held
+func (a *AkwatekCtl) parseSensors(v1 *ReqItekV1) (map[int]*LeakoSensor, error) {
 	rawSensors := []byte(v1.Zone01To25)
 	rawSensors = append(rawSensors, []byte(v1.Zone26To50)...)
 	rawSensors = append(rawSensors, []byte(v1.Zone51To75)...)
 	rawSensors = append(rawSensors, []byte(v1.Zone76To100)...)
 
+	sensors := make(map[int]*LeakoSensor, len(a.sensors))
+	for id, sensor := range a.sensors {
+		sensors[id] = sensor
+	}
+
 	for id, rawSensor := range rawSensors {
 		raw, err := strconv.ParseInt(string(rawSensor), 16, 8)
 		if err != nil {
-			return err
+			return nil, err
 		}
+		previous, known := sensors[id+1]
 		if raw == 0x0 {
+			// the sensor was unpaired from the controller, keep it until its removal grace period is over
+			if known && !previous.IsRemoved() {
+				sensors[id+1] = &LeakoSensor{
+					ID:          id + 1,
+					Value:       previous.Value,
+					Ctl:         a,
+					RemovedAt:   time.Now(),
+					JustRemoved: true,
+				}
+			} else if known && previous.JustRemoved {
+				removed := *previous
+				removed.JustRemoved = false
+				sensors[id+1] = &removed
+			}
 			continue
 		}
-		a.Sensors[id+1] = &LeakoSensor{
+		sensor := &LeakoSensor{
 			ID:    id + 1,
 			Value: uint8(raw),
 			Ctl:   a,
 		}
+		sensor.JustPaired = sensor.IsConfigured() && (!known || previous.IsRemoved() || !previous.IsConfigured())
+		sensors[id+1] = sensor
 	}
-	return nil
+	return sensors, nil
+}
+
+// ForgetSensor remove a sensor once its removal is published
+func (a *AkwatekCtl) ForgetSensor(id int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	sensors := make(map[int]*LeakoSensor, len(a.sensors))
+	for sensorID, sensor := range a.sensors {
+		if sensorID != id {
+			sensors[sensorID] = sensor
+		}
+	}
+	a.sensors = sensors
+}
+
+func (a *AkwatekCtl) getValue() []byte {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.value
+}
+
+// GetSensors return the sensors sorted by zone
+func (a *AkwatekCtl) GetSensors() []*LeakoSensor {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	sensors := make([]*LeakoSensor, 0, len(a.sensors))
+	for _, sensor := range a.sensors {
+		sensors = append(sensors, sensor)
+	}
+	sort.Slice(sensors, func(i, j int) bool {
+		return sensors[i].ID < sensors[j].ID
+	})
+	return sensors
+}
+
+func (a *AkwatekCtl) GetLastRequest() ReqItekV1 {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.lastRequest
+}
+
+func (a *AkwatekCtl) GetLastSeen() time.Time {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.lastSeen
+}
+
+// SetOffline return true if the controller wasn't already in this state
+func (a *AkwatekCtl) SetOffline(offline bool) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	changed := a.offline != offline
+	a.offline = offline
+	return changed
+}
+
+func (a *AkwatekCtl) IsOffline() bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.offline
+}
+
+func (a *AkwatekCtl) GetLastHassConfigPublished() time.Time {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.lastHassConfigPublished
+}
+
+func (a *AkwatekCtl) IsHassConfigPublished() bool {
+	return a.GetLastHassConfigPublished().After(time.UnixMicro(0))
+}
+
+func (a *AkwatekCtl) SetLastHassConfigPublished(t time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.lastHassConfigPublished = t
 }
 
 func (a *AkwatekCtl) HasPowerLine() bool {
-	return a.Value[0]&0b1 == 0b1
+	return hasPowerLine(a.getValue())
+}
+
+func hasPowerLine(value []byte) bool {
+	return value[0]&0b1 == 0b1
 }
 
+// IsValveOpen return the valve bit of the controller status, the real valve even in dry-run,
+// it's what the controller report in the logs and the "valve" of the state
 func (a *AkwatekCtl) IsValveOpen() bool {
-	return a.Value[4]&0b1 == 0b1
+	return a.getValue()[4]&0b1 == 0b1
+}
+
+// IsSimulatedValveOpen return the simulated valve in dry-run once a command was taken, until the valve bit change,
+// the valve bit otherwise. It's the valve the commands act on: the valve state, the command confirmation
+// and the schedules use it, so a command not sent in dry-run isn't sent again as if the valve didn't move
+func (a *AkwatekCtl) IsSimulatedValveOpen() bool {
+	a.mu.RLock()
+	simulatedValveOpen := a.simulatedValveOpen
+	a.mu.RUnlock()
+	if simulatedValveOpen != nil {
+		return *simulatedValveOpen
+	}
+	return a.IsValveOpen()
+}
+
+// SetDryRun enable the dry-run, the valve commands are never sent and only move a simulated valve
+func (a *AkwatekCtl) SetDryRun(dryRun bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.dryRun = dryRun
+	a.simulatedValveOpen = nil
+}
+
+func (a *AkwatekCtl) IsDryRun() bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.dryRun
+}
+
+func (a *AkwatekCtl) SetMetadata(metadata *CtlMetadata) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.metadata = metadata
+}
+
+func (a *AkwatekCtl) getMetadata() *CtlMetadata {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.metadata
+}
+
+// GetName return the friendly name of the controller, its Home Assistant node id if it has none
+func (a *AkwatekCtl) GetName() string {
+	if name := a.getMetadata().Name; name != "" {
+		return name
+	}
+	return a.GetMQTTHassNodeId()
+}
+
+// GetZone return the metadata of a zone, empty if it has none
+func (a *AkwatekCtl) GetZone(id int) *ZoneMetadata {
+	if zone, ok := a.getMetadata().Zones[id]; ok {
+		return zone
+	}
+	return &ZoneMetadata{}
 }
 
 func (a *AkwatekCtl) ValveState() string {
-	valveOpen := a.IsValveOpen()
+	valveOpen := a.IsSimulatedValveOpen()
+	command := a.GetValveCommand()
 
-	// Handle the 2min delay feedback for valve action
-	if a.valveAction != nil &&
-		*a.valveAction == VALVE_ACTION_CLOSE &&
+	// Handle the 2min delay feedback for valve action, until the command is confirmed or failed
+	if command != nil && !command.IsDone() &&
+		command.Action == VALVE_ACTION_CLOSE &&
 		valveOpen {
 		return "closing"
 	}
 	// Handle the 2min delay feedback for valve action if no Alarm (can't open remotely)
-	if a.valveAction != nil &&
-		*a.valveAction == VALVE_ACTION_OPEN &&
+	if command != nil && !command.IsDone() &&
+		command.Action == VALVE_ACTION_OPEN &&
 		!valveOpen && !a.HasAlarm() {
 		return "opening"
 	}
@@ -110,33 +403,235 @@ func (a *AkwatekCtl) ValveState() string {
 }
 
 func (a *AkwatekCtl) HasAlarm() bool {
-	return a.Value[2]&0b1 == 0b1
+	return hasAlarm(a.getValue())
+}
+
+func hasAlarm(value []byte) bool {
+	return value[2]&0b1 == 0b1
 }
 
 func (a *AkwatekCtl) HasBattery() bool {
-	return a.Value[1]&0b1000 == 0b1000
+	return a.getValue()[1]&0b1000 == 0b1000
 }
 
 func (a *AkwatekCtl) String() string {
-	return fmt.Sprintf("%s power=%t battery=%t valve=%t alarm=%t", a.MAC.String(), a.HasPowerLine(), a.HasBattery(), a.IsValveOpen(), a.HasAlarm())
+	str := fmt.Sprintf("%s power=%t battery=%t valve=%t alarm=%t", a.MAC.String(), a.HasPowerLine(), a.HasBattery(), a.IsValveOpen(), a.HasAlarm())
+	if a.IsDryRun() {
+		str += fmt.Sprintf(" simulated_valve=%t", a.IsSimulatedValveOpen())
+	}
+	return str
 }
 
 func (a *AkwatekCtl) GetIdentifier() string {
-	return strings.ReplaceAll(a.MAC.String(), ":", "-")
+	return GetIdentifierFromMAC(a.MAC)
+}
+
+func GetIdentifierFromMAC(mac net.HardwareAddr) string {
+	return strings.ReplaceAll(mac.String(), ":", "-")
+}
+
+// QueueValveCommand replace the current valve command by a new pending one,
+// the previous command is returned as superseded if it wasn't done yet
+func (a *AkwatekCtl) QueueValveCommand(command *ValveCommand) (superseded *ValveCommand) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.valveCommand != nil && !a.valveCommand.IsDone() {
+		superseded = a.valveCommand.with(VALVE_COMMAND_SUPERSEDED, "replaced by a new command")
+		a.setValveCommand(superseded)
+	}
+	a.setValveCommand(command)
+	return superseded
+}
+
+// setValveCommand replace the current valve command, a done command is added to the history, mu must be held
+func (a *AkwatekCtl) setValveCommand(command *ValveCommand) {
+	a.valveCommand = command
+	if !command.IsDone() {
+		return
+	}
+	history := append(ValveCommandHistory{command}, a.valveCommandHistory...)
+	if len(history) > VALVE_COMMAND_HISTORY {
+		history = history[:VALVE_COMMAND_HISTORY]
+	}
+	a.valveCommandHistory = history
+}
+
+// GetValveCommandHistory return the last done valve commands, most recent first
+func (a *AkwatekCtl) GetValveCommandHistory() ValveCommandHistory {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.valveCommandHistory
+}
+
+func (a *AkwatekCtl) GetValveCommand() *ValveCommand {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.valveCommand
+}
+
+// CheckValveCommand compare the sent valve command with the status of the last check-in,
+// the command is confirmed by the valve bit, sent again after confirmCheckIns check-ins
+// and failed after maxAttempts. The command is returned only when it's confirmed or failed.
+func (a *AkwatekCtl) CheckValveCommand(confirmCheckIns int, maxAttempts int) *ValveCommand {
+	valveOpen := a.IsSimulatedValveOpen()
+	alarm := a.HasAlarm()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	command := a.valveCommand
+	if command == nil || command.IsDone() {
+		return nil
+	}
+	// the controller ignore a remote opening while the alarm is on
+	if command.Action == VALVE_ACTION_OPEN && alarm {
+		a.setValveCommand(command.with(VALVE_COMMAND_FAILED, "the valve can't be opened remotely while the alarm is on"))
+		return a.valveCommand
+	}
+	if command.Status != VALVE_COMMAND_SENT {
+		return nil
+	}
+
+	command = command.with(VALVE_COMMAND_SENT, "")
+	command.CheckIns++
+	a.valveCommand = command
+	if valveOpen == (command.Action == VALVE_ACTION_OPEN) {
+		a.setValveCommand(command.with(VALVE_COMMAND_CONFIRMED, ""))
+		return a.valveCommand
+	}
+	if command.CheckIns < confirmCheckIns {
+		return nil
+	}
+	if command.Attempts >= maxAttempts {
+		a.setValveCommand(command.with(VALVE_COMMAND_FAILED,
+			fmt.Sprintf("valve state unchanged after %d attempts", command.Attempts)))
+		return a.valveCommand
+	}
+	// send it again on this check-in
+	a.valveCommand = command.with(VALVE_COMMAND_PENDING, "")
+	return nil
+}
+
+// TakeValveCommand atomically mark the pending valve command as sent and return it,
+// so a command received while a request is handled is kept for the next one
+func (a *AkwatekCtl) TakeValveCommand() *ValveCommand {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.valveCommand == nil || a.valveCommand.Status != VALVE_COMMAND_PENDING {
+		return nil
+	}
+	command := a.valveCommand.with(VALVE_COMMAND_SENT, "")
+	command.Attempts++
+	command.CheckIns = 0
+	a.valveCommand = command
+	if a.dryRun {
+		valveOpen := command.Action == VALVE_ACTION_OPEN
+		a.simulatedValveOpen = &valveOpen
+	}
+	return command
+}
+
+// SupersedeSentValveCommand mark the command just taken as superseded when another action was sent in its place,
+// it isn't counted as an attempt and isn't sent again. The superseded command is returned, nil if it's not the current one anymore
+func (a *AkwatekCtl) SupersedeSentValveCommand(command *ValveCommand, errMessage string) *ValveCommand {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.valveCommand == nil || a.valveCommand.ID != command.ID || a.valveCommand.Status != VALVE_COMMAND_SENT {
+		return nil
+	}
+	superseded := a.valveCommand.with(VALVE_COMMAND_SUPERSEDED, errMessage)
+	superseded.Attempts--
+	a.setValveCommand(superseded)
+	return superseded
+}
+
+// HasWater return the first zone of a sensor detecting water
+func (a *AkwatekCtl) HasWater() (bool, int) {
+	for _, sensor := range a.GetSensors() {
+		if sensor.IsConfigured() && !sensor.IsRemoved() && sensor.IsWaterDetected() {
+			return true, sensor.ID
+		}
+	}
+	return false, 0
+}
+
+// NewValveOverride replace the override token of the controller by a new one valid for ttl
+func (a *AkwatekCtl) NewValveOverride(ttl time.Duration) (*ValveOverride, error) {
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return nil, err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.override = &ValveOverride{
+		Token:     hex.EncodeToString(token),
+		ExpiresAt: time.Now().Add(ttl),
+	}
+	return a.override, nil
 }
 
-func (a *AkwatekCtl) ValveCallback() func(ValveAction) {
-	return func(value ValveAction) {
-		a.valveAction = &value
+// UseValveOverride return true if the token is the valid override token, it can be used only once
+func (a *AkwatekCtl) UseValveOverride(token string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.override == nil || time.Now().After(a.override.ExpiresAt) ||
+		subtle.ConstantTimeCompare([]byte(token), []byte(a.override.Token)) != 1 {
+		return false
 	}
+	a.override = nil
+	return true
+}
+
+func (a *AkwatekCtl) IsScheduleEnabled(name string) bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return !slices.Contains(a.disabledSchedules, name)
+}
+
+// ScheduleState is the progress of a schedule for a controller, persisted so a restart doesn't leave the valve closed:
+// Next is the next due time of an exercise and Command the closing of the running one, Active is true during a vacation
+type ScheduleState struct {
+	Next     time.Time `json:"next"`
+	Command  string    `json:"command,omitempty"`
+	CheckIns int       `json:"checkins,omitempty"`
+	Active   bool      `json:"active,omitempty"`
+}
+
+// GetScheduleState return the state of a schedule, false if it has none yet
+func (a *AkwatekCtl) GetScheduleState(name string) (ScheduleState, bool) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	state, ok := a.scheduleStates[name]
+	return state, ok
 }
 
-func (a *AkwatekCtl) GetValveAction() *ValveAction {
-	return a.valveAction
+// SetScheduleState replace the state of a schedule, the map is replaced so a snapshot is never modified
+func (a *AkwatekCtl) SetScheduleState(name string, state ScheduleState) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	states := make(map[string]ScheduleState, len(a.scheduleStates)+1)
+	for key, value := range a.scheduleStates {
+		states[key] = value
+	}
+	states[name] = state
+	a.scheduleStates = states
 }
 
-func (a *AkwatekCtl) ResetValveAction() {
-	a.valveAction = nil
+// SetScheduleEnabled toggle a schedule of the controller, it return true if it changed
+func (a *AkwatekCtl) SetScheduleEnabled(name string, enabled bool) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	disabled := slices.Contains(a.disabledSchedules, name)
+	if disabled != enabled {
+		return false
+	}
+	if enabled {
+		a.disabledSchedules = slices.DeleteFunc(slices.Clone(a.disabledSchedules), func(s string) bool {
+			return s == name
+		})
+	} else {
+		a.disabledSchedules = append(slices.Clone(a.disabledSchedules), name)
+	}
+	return true
 }
 
 func (a *AkwatekCtl) GetMQTTAvailabilityTopic(baseTopic string) string {
@@ -147,10 +642,82 @@ func (a *AkwatekCtl) GetMQTTStateTopic(baseTopic string) string {
 	return fmt.Sprintf("%s/%s/controller/state", baseTopic, a.GetIdentifier())
 }
 
+func (a *AkwatekCtl) GetMQTTEventTopic(baseTopic string) string {
+	return fmt.Sprintf("%s/%s/controller/event", baseTopic, a.GetIdentifier())
+}
+
+// GetMQTTUserProperties return the MQTT v5 user properties of the controller, its MAC and the raw ID of its last check-in
+func (a *AkwatekCtl) GetMQTTUserProperties() map[string]string {
+	return map[string]string{
+		"mac": a.MAC.String(),
+		"id":  a.GetLastRequest().ID,
+	}
+}
+
+func (a *AkwatekCtl) GetMQTTValveResultTopic(baseTopic string) string {
+	return fmt.Sprintf("%s/%s/controller/valve/result", baseTopic, a.GetIdentifier())
+}
+
+func (a *AkwatekCtl) GetMQTTValveErrorTopic(baseTopic string) string {
+	return fmt.Sprintf("%s/%s/controller/valve/error", baseTopic, a.GetIdentifier())
+}
+
+func (a *AkwatekCtl) GetMQTTValveHistoryTopic(baseTopic string) string {
+	return fmt.Sprintf("%s/%s/controller/valve/history", baseTopic, a.GetIdentifier())
+}
+
+func (a *AkwatekCtl) GetMQTTScheduleStateTopic(baseTopic string, name string) string {
+	return fmt.Sprintf("%s/%s/schedules/%s/state", baseTopic, a.GetIdentifier(), name)
+}
+
+func (a *AkwatekCtl) GetMQTTScheduleCommandTopic(baseTopic string, name string) string {
+	return fmt.Sprintf("%s/%s/schedules/%s/set", baseTopic, a.GetIdentifier(), name)
+}
+
+func (a *AkwatekCtl) GetMQTTValveOverrideTopic(baseTopic string) string {
+	return fmt.Sprintf("%s/%s/controller/valve/override", baseTopic, a.GetIdentifier())
+}
+
+func (a *AkwatekCtl) GetMQTTValveOverrideTokenTopic(baseTopic string) string {
+	return fmt.Sprintf("%s/%s/controller/valve/override/token", baseTopic, a.GetIdentifier())
+}
+
 func (a *AkwatekCtl) GetMQTTHassNodeId() string {
 	return fmt.Sprintf("%s-%s", MANUFACTURER_PREFIX, a.GetIdentifier())
 }
 
+// GetMQTTHassDevice is the Home Assistant device of the controller entities,
+// the ID field of the requests isn't known to be a version, it's only a diagnostic
+func (a *AkwatekCtl) GetMQTTHassDevice() HassDeviceDiscoveryPayload {
+	metadata := a.getMetadata()
+	return HassDeviceDiscoveryPayload{
+		Name:             a.GetName(),
+		Manufacturer:     MANUFACTURER,
+		Model:            CTL_MODEL,
+		Identifiers:      []string{a.GetMQTTHassNodeId()},
+		Connections:      [][2]string{{"mac", a.MAC.String()}},
+		SuggestedArea:    metadata.Area,
+		ConfigurationURL: metadata.ConfigurationURL,
+	}
+}
+
+// GetMQTTHassEntities return the entities of the controller, but the schedules ones
+func (a *AkwatekCtl) GetMQTTHassEntities(baseTopic string) []*HassEntity {
+	entities := []*HassEntity{
+		{Component: "valve", ObjectID: "valve", Config: a.GetMQTTValveHassConfig(baseTopic)},
+		{Component: "binary_sensor", ObjectID: "alarm", Config: a.GetMQTTAlarmHassConfig(baseTopic)},
+		{Component: "binary_sensor", ObjectID: "power", Config: a.GetMQTTPowerHassConfig(baseTopic)},
+		{Component: "binary_sensor", ObjectID: "battery", Config: a.GetMQTTBatteryHassConfig(baseTopic)},
+		{Component: "sensor", ObjectID: "valve_error", Config: a.GetMQTTValveErrorHassConfig(baseTopic)},
+	}
+	return append(entities, a.GetMQTTDiagnosticsHassEntities(baseTopic)...)
+}
+
+// GetMQTTHassDeviceConfigTopic is the device discovery topic of the controller
+func (a *AkwatekCtl) GetMQTTHassDeviceConfigTopic(hassPrefix string) string {
+	return GetMQTTHassDeviceConfigTopic(hassPrefix, a.GetMQTTHassNodeId())
+}
+
 func (a *AkwatekCtl) GetMQTTValveHassConfigTopic(hassPrefix string) string {
 	return fmt.Sprintf("%s/valve/%s/valve/config", hassPrefix, a.GetMQTTHassNodeId())
 }
@@ -161,18 +728,15 @@ func (a *AkwatekCtl) GetMQTTSValveCommandTopic(baseTopic string) string {
 
 func (a *AkwatekCtl) GetMQTTValveHassConfig(baseTopic string) *HassDiscoveryPayload {
 	return &HassDiscoveryPayload{
-		Name:              "valve",
-		AvailabilityTopic: a.GetMQTTAvailabilityTopic(baseTopic),
-		DeviceClass:       "water",
-		CommandTopic:      a.GetMQTTSValveCommandTopic(baseTopic),
-		StateTopic:        a.GetMQTTStateTopic(baseTopic),
-		UniqueId:          fmt.Sprintf("%s_valve", a.GetMQTTHassNodeId()),
-		ValueTemplate:     "{{ value_json.valve_state }}",
-		Device: HassDeviceDiscoveryPayload{
-			Name:         a.GetMQTTHassNodeId(),
-			Manufacturer: MANUFACTURER,
-			Identifiers:  []string{a.GetMQTTHassNodeId()},
-		},
+		Name:             "valve",
+		Availability:     hassAvailability(baseTopic, a.GetMQTTAvailabilityTopic(baseTopic)),
+		AvailabilityMode: "all",
+		DeviceClass:      "water",
+		CommandTopic:     a.GetMQTTSValveCommandTopic(baseTopic),
+		StateTopic:       a.GetMQTTStateTopic(baseTopic),
+		UniqueId:         fmt.Sprintf("%s_valve", a.GetMQTTHassNodeId()),
+		ValueTemplate:    "{{ value_json.valve_state }}",
+		Device:           a.GetMQTTHassDevice(),
 	}
 }
 
@@ -182,19 +746,16 @@ func (a *AkwatekCtl) GetMQTTPowerHassConfigTopic(hassPrefix string) string {
 
 func (a *AkwatekCtl) GetMQTTPowerHassConfig(baseTopic string) *HassDiscoveryPayload {
 	return &HassDiscoveryPayload{
-		Name:              "power",
-		AvailabilityTopic: a.GetMQTTAvailabilityTopic(baseTopic),
-		DeviceClass:       "power",
-		StateTopic:        a.GetMQTTStateTopic(baseTopic),
-		UniqueId:          fmt.Sprintf("%s_power", a.GetMQTTHassNodeId()),
-		ValueTemplate:     "{{ value_json.powerLine | abs }}",
-		PayloadOff:        "0",
-		PayloadOn:         "1",
-		Device: HassDeviceDiscoveryPayload{
-			Name:         a.GetMQTTHassNodeId(),
-			Manufacturer: MANUFACTURER,
-			Identifiers:  []string{a.GetMQTTHassNodeId()},
-		},
+		Name:             "power",
+		Availability:     hassAvailability(baseTopic, a.GetMQTTAvailabilityTopic(baseTopic)),
+		AvailabilityMode: "all",
+		DeviceClass:      "power",
+		StateTopic:       a.GetMQTTStateTopic(baseTopic),
+		UniqueId:         fmt.Sprintf("%s_power", a.GetMQTTHassNodeId()),
+		ValueTemplate:    "{{ value_json.powerLine | abs }}",
+		PayloadOff:       "0",
+		PayloadOn:        "1",
+		Device:           a.GetMQTTHassDevice(),
 	}
 }
 
@@ -204,19 +765,16 @@ func (a *AkwatekCtl) GetMQTTBatteryHassConfigTopic(hassPrefix string) string {
 
 func (a *AkwatekCtl) GetMQTTBatteryHassConfig(baseTopic string) *HassDiscoveryPayload {
 	return &HassDiscoveryPayload{
-		Name:              "battery",
-		AvailabilityTopic: a.GetMQTTAvailabilityTopic(baseTopic),
-		DeviceClass:       "problem",
-		StateTopic:        a.GetMQTTStateTopic(baseTopic),
-		UniqueId:          fmt.Sprintf("%s_battery", a.GetMQTTHassNodeId()),
-		ValueTemplate:     "{{ value_json.battery | abs }}",
-		PayloadOff:        "1",
-		PayloadOn:         "0",
-		Device: HassDeviceDiscoveryPayload{
-			Name:         a.GetMQTTHassNodeId(),
-			Manufacturer: MANUFACTURER,
-			Identifiers:  []string{a.GetMQTTHassNodeId()},
-		},
+		Name:             "battery",
+		Availability:     hassAvailability(baseTopic, a.GetMQTTAvailabilityTopic(baseTopic)),
+		AvailabilityMode: "all",
+		DeviceClass:      "problem",
+		StateTopic:       a.GetMQTTStateTopic(baseTopic),
+		UniqueId:         fmt.Sprintf("%s_battery", a.GetMQTTHassNodeId()),
+		ValueTemplate:    "{{ value_json.battery | abs }}",
+		PayloadOff:       "1",
+		PayloadOn:        "0",
+		Device:           a.GetMQTTHassDevice(),
 	}
 }
 
@@ -226,44 +784,105 @@ func (a *AkwatekCtl) GetMQTTAlarmHassConfigTopic(hassPrefix string) string {
 
 func (a *AkwatekCtl) GetMQTTAlarmHassConfig(baseTopic string) *HassDiscoveryPayload {
 	return &HassDiscoveryPayload{
-		Name:              "alarm",
-		AvailabilityTopic: a.GetMQTTAvailabilityTopic(baseTopic),
-		DeviceClass:       "problem",
-		StateTopic:        a.GetMQTTStateTopic(baseTopic),
-		UniqueId:          fmt.Sprintf("%s_alarm", a.GetMQTTHassNodeId()),
-		ValueTemplate:     "{{ value_json.alarm | abs }}",
-		PayloadOff:        "0",
-		PayloadOn:         "1",
-		Device: HassDeviceDiscoveryPayload{
-			Name:         a.GetMQTTHassNodeId(),
-			Manufacturer: MANUFACTURER,
-			Identifiers:  []string{a.GetMQTTHassNodeId()},
-		},
+		Name:             "alarm",
+		Availability:     hassAvailability(baseTopic, a.GetMQTTAvailabilityTopic(baseTopic)),
+		AvailabilityMode: "all",
+		DeviceClass:      "problem",
+		StateTopic:       a.GetMQTTStateTopic(baseTopic),
+		UniqueId:         fmt.Sprintf("%s_alarm", a.GetMQTTHassNodeId()),
+		ValueTemplate:    "{{ value_json.alarm | abs }}",
+		PayloadOff:       "0",
+		PayloadOn:        "1",
+		Device:           a.GetMQTTHassDevice(),
+	}
+}
+
+func (a *AkwatekCtl) GetMQTTValveErrorHassConfigTopic(hassPrefix string) string {
+	return fmt.Sprintf("%s/sensor/%s/valve_error/config", hassPrefix, a.GetMQTTHassNodeId())
+}
+
+// GetMQTTValveErrorHassConfig show why the last valve command was refused
+func (a *AkwatekCtl) GetMQTTValveErrorHassConfig(baseTopic string) *HassDiscoveryPayload {
+	return &HassDiscoveryPayload{
+		Name:             "valve error",
+		Availability:     hassAvailability(baseTopic, a.GetMQTTAvailabilityTopic(baseTopic)),
+		AvailabilityMode: "all",
+		StateTopic:       a.GetMQTTValveErrorTopic(baseTopic),
+		UniqueId:         fmt.Sprintf("%s_valve_error", a.GetMQTTHassNodeId()),
+		ValueTemplate:    "{{ value_json.error }}",
+		Device:           a.GetMQTTHassDevice(),
+	}
+}
+
+func (a *AkwatekCtl) GetMQTTScheduleHassConfigTopic(hassPrefix string, name string) string {
+	return fmt.Sprintf("%s/switch/%s/schedule_%s/config", hassPrefix, a.GetMQTTHassNodeId(), name)
+}
+
+func (a *AkwatekCtl) GetMQTTScheduleHassEntity(baseTopic string, name string) *HassEntity {
+	return &HassEntity{
+		Component: "switch",
+		ObjectID:  fmt.Sprintf("schedule_%s", name),
+		Config:    a.GetMQTTScheduleHassConfig(baseTopic, name),
+	}
+}
+
+// GetMQTTScheduleHassConfig is the switch enabling a schedule of the controller
+func (a *AkwatekCtl) GetMQTTScheduleHassConfig(baseTopic string, name string) *HassDiscoveryPayload {
+	return &HassDiscoveryPayload{
+		Name:             fmt.Sprintf("schedule %s", name),
+		Availability:     hassAvailability(baseTopic, a.GetMQTTAvailabilityTopic(baseTopic)),
+		AvailabilityMode: "all",
+		DeviceClass:      "switch",
+		CommandTopic:     a.GetMQTTScheduleCommandTopic(baseTopic, name),
+		StateTopic:       a.GetMQTTScheduleStateTopic(baseTopic, name),
+		UniqueId:         fmt.Sprintf("%s_schedule_%s", a.GetMQTTHassNodeId(), name),
+		PayloadOff:       "OFF",
+		PayloadOn:        "ON",
+		Device:           a.GetMQTTHassDevice(),
 	}
 }
 
 func (a *AkwatekCtl) MarshalJSON() ([]byte, error) {
+	// the valve is the real one, the simulated one is only in dry-run
+	var simulatedValveOpen *bool
+	dryRun := a.IsDryRun()
+	if dryRun {
+		valveOpen := a.IsSimulatedValveOpen()
+		simulatedValveOpen = &valveOpen
+	}
 	return json.Marshal(&struct {
-		Mac        string `json:"mac"`
-		ValveOpen  bool   `json:"valve"`
-		ValveState string `json:"valve_state"`
-		Battery    bool   `json:"battery"`
-		PowerLine  bool   `json:"powerLine"`
-		Alarm      bool   `json:"alarm"`
+		Mac            string `json:"mac"`
+		ValveOpen      bool   `json:"valve"`
+		SimulatedValve *bool  `json:"simulated_valve,omitempty"`
+		ValveState     string `json:"valve_state"`
+		Battery        bool   `json:"battery"`
+		PowerLine      bool   `json:"powerLine"`
+		Alarm          bool   `json:"alarm"`
+		DryRun         bool   `json:"dry_run,omitempty"`
 	}{
-		Mac:        a.MAC.String(),
-		ValveOpen:  a.IsValveOpen(),
-		ValveState: a.ValveState(),
-		Battery:    a.HasBattery(),
-		PowerLine:  a.HasPowerLine(),
-		Alarm:      a.HasAlarm(),
+		Mac:            a.MAC.String(),
+		ValveOpen:      a.IsValveOpen(),
+		SimulatedValve: simulatedValveOpen,
+		ValveState:     a.ValveState(),
+		Battery:        a.HasBattery(),
+		PowerLine:      a.HasPowerLine(),
+		Alarm:          a.HasAlarm(),
+		DryRun:         dryRun,
 	})
 }
 
 type LeakoSensor struct {
-	ID    int
-	Value byte
-	Ctl   *AkwatekCtl
+	ID          int
+	Value       byte
+	Ctl         *AkwatekCtl
+	RemovedAt   time.Time
+	JustPaired  bool
+	JustRemoved bool
+}
+
+// IsRemoved return true if the zone of the sensor went back to 0
+func (a *LeakoSensor) IsRemoved() bool {
+	return !a.RemovedAt.IsZero()
 }
 
 func (a *LeakoSensor) IsWaterDetected() bool {
@@ -315,6 +934,44 @@ func (a *LeakoSensor) GetIdentifier() string {
 	return fmt.Sprintf("%s-%s_%d", MANUFACTURER_PREFIX, a.Ctl.GetIdentifier(), a.ID)
 }
 
+// GetName return the friendly name of the zone, its number if it has none
+func (a *LeakoSensor) GetName() string {
+	if name := a.Ctl.GetZone(a.ID).Name; name != "" {
+		return name
+	}
+	return strconv.Itoa(a.ID)
+}
+
+// IsIgnored return true if the zone is ignored in the config, it's neither published nor used by the policies
+func (a *LeakoSensor) IsIgnored() bool {
+	return a.Ctl.GetZone(a.ID).Ignore
+}
+
+// HasOwnDevice return true if the sensor isn't in the device of the controller,
+// with SensorDevices or when its zone has an area since Home Assistant only set the area of a device
+func (a *LeakoSensor) HasOwnDevice() bool {
+	return a.Ctl.getMetadata().SensorDevices || a.Ctl.GetZone(a.ID).Area != ""
+}
+
+// GetMQTTHassDevice is the device of the controller, or the sensor own device connected through the controller
+func (a *LeakoSensor) GetMQTTHassDevice() HassDeviceDiscoveryPayload {
+	if !a.HasOwnDevice() {
+		return a.Ctl.GetMQTTHassDevice()
+	}
+	name := a.Ctl.GetZone(a.ID).Name
+	if name == "" {
+		name = fmt.Sprintf("zone %d", a.ID)
+	}
+	return HassDeviceDiscoveryPayload{
+		Name:          fmt.Sprintf("%s %s", a.Ctl.GetName(), name),
+		Manufacturer:  MANUFACTURER,
+		Model:         SENSOR_MODEL,
+		Identifiers:   []string{a.GetIdentifier()},
+		SuggestedArea: a.Ctl.GetZone(a.ID).Area,
+		ViaDevice:     a.Ctl.GetMQTTHassNodeId(),
+	}
+}
+
 func (a *LeakoSensor) GetMQTTAvailabilityTopic(baseTopic string) string {
 	return fmt.Sprintf("%s/%s/sensors/%d/availability", baseTopic, a.Ctl.GetIdentifier(), a.ID)
 }
@@ -323,25 +980,52 @@ func (a *LeakoSensor) GetMQTTStateTopic(baseTopic string) string {
 	return fmt.Sprintf("%s/%s/sensors/%d/state", baseTopic, a.Ctl.GetIdentifier(), a.ID)
 }
 
+// GetMQTTUserProperties return the MQTT v5 user properties identifying the sensor
+func (a *LeakoSensor) GetMQTTUserProperties() map[string]string {
+	properties := a.Ctl.GetMQTTUserProperties()
+	properties["zone"] = strconv.Itoa(a.ID)
+	return properties
+}
+
+// GetMQTTHassEntities return the entities of the sensor
+func (a *LeakoSensor) GetMQTTHassEntities(baseTopic string) []*HassEntity {
+	return []*HassEntity{
+		{Component: "binary_sensor", ObjectID: fmt.Sprintf("sensor-%d-bat", a.ID), Config: a.GetMQTTBatHassConfig(baseTopic)},
+		{Component: "binary_sensor", ObjectID: fmt.Sprintf("sensor-%d-leak", a.ID), Config: a.GetMQTTLeakHassConfig(baseTopic)},
+		{Component: "binary_sensor", ObjectID: fmt.Sprintf("sensor-%d-lost", a.ID), Config: a.GetMQTTSignalHassConfig(baseTopic)},
+	}
+}
+
+// GetMQTTHassDeviceConfigTopic is the device discovery topic of a sensor with its own device
+func (a *LeakoSensor) GetMQTTHassDeviceConfigTopic(hassPrefix string) string {
+	return GetMQTTHassDeviceConfigTopic(hassPrefix, a.GetIdentifier())
+}
+
+// GetMQTTHassConfigTopics return every discovery topic of the sensor
+func (a *LeakoSensor) GetMQTTHassConfigTopics(hassPrefix string) []string {
+	return []string{
+		a.GetMQTTBatHassConfigTopic(hassPrefix),
+		a.GetMQTTLeakHassConfigTopic(hassPrefix),
+		a.GetMQTTSignalHassConfigTopic(hassPrefix),
+	}
+}
+
 func (a *LeakoSensor) GetMQTTLeakHassConfigTopic(hassPrefix string) string {
 	return fmt.Sprintf("%s/binary_sensor/%s/sensor-%d-leak/config", hassPrefix, a.Ctl.GetMQTTHassNodeId(), a.ID)
 }
 
 func (a *LeakoSensor) GetMQTTLeakHassConfig(baseTopic string) *HassDiscoveryPayload {
 	return &HassDiscoveryPayload{
-		Name:              fmt.Sprintf("%d", a.ID),
-		AvailabilityTopic: a.GetMQTTAvailabilityTopic(baseTopic),
-		DeviceClass:       "moisture",
-		StateTopic:        a.GetMQTTStateTopic(baseTopic),
-		UniqueId:          fmt.Sprintf("%s_%d-leak", a.Ctl.GetMQTTHassNodeId(), a.ID),
-		ValueTemplate:     "{{ value_json.leak | abs }}",
-		PayloadOff:        "0",
-		PayloadOn:         "1",
-		Device: HassDeviceDiscoveryPayload{
-			Name:         a.Ctl.GetMQTTHassNodeId(),
-			Manufacturer: MANUFACTURER,
-			Identifiers:  []string{a.Ctl.GetMQTTHassNodeId()},
-		},
+		Name:             a.GetName(),
+		Availability:     hassAvailability(baseTopic, a.GetMQTTAvailabilityTopic(baseTopic)),
+		AvailabilityMode: "all",
+		DeviceClass:      "moisture",
+		StateTopic:       a.GetMQTTStateTopic(baseTopic),
+		UniqueId:         fmt.Sprintf("%s_%d-leak", a.Ctl.GetMQTTHassNodeId(), a.ID),
+		ValueTemplate:    "{{ value_json.leak | abs }}",
+		PayloadOff:       "0",
+		PayloadOn:        "1",
+		Device:           a.GetMQTTHassDevice(),
 	}
 }
 
@@ -351,19 +1035,16 @@ func (a *LeakoSensor) GetMQTTBatHassConfigTopic(hassPrefix string) string {
 
 func (a *LeakoSensor) GetMQTTBatHassConfig(baseTopic string) *HassDiscoveryPayload {
 	return &HassDiscoveryPayload{
-		Name:              fmt.Sprintf("%d", a.ID),
-		AvailabilityTopic: a.GetMQTTAvailabilityTopic(baseTopic),
-		DeviceClass:       "battery",
-		StateTopic:        a.GetMQTTStateTopic(baseTopic),
-		UniqueId:          fmt.Sprintf("%s_%d-battery", a.Ctl.GetMQTTHassNodeId(), a.ID),
-		ValueTemplate:     "{{ value_json.low_bat | abs }}",
-		PayloadOff:        "0",
-		PayloadOn:         "1",
-		Device: HassDeviceDiscoveryPayload{
-			Name:         a.Ctl.GetMQTTHassNodeId(),
-			Manufacturer: MANUFACTURER,
-			Identifiers:  []string{a.Ctl.GetMQTTHassNodeId()},
-		},
+		Name:             a.GetName(),
+		Availability:     hassAvailability(baseTopic, a.GetMQTTAvailabilityTopic(baseTopic)),
+		AvailabilityMode: "all",
+		DeviceClass:      "battery",
+		StateTopic:       a.GetMQTTStateTopic(baseTopic),
+		UniqueId:         fmt.Sprintf("%s_%d-battery", a.Ctl.GetMQTTHassNodeId(), a.ID),
+		ValueTemplate:    "{{ value_json.low_bat | abs }}",
+		PayloadOff:       "0",
+		PayloadOn:        "1",
+		Device:           a.GetMQTTHassDevice(),
 	}
 }
 
@@ -373,19 +1054,16 @@ func (a *LeakoSensor) GetMQTTSignalHassConfigTopic(hassPrefix string) string {
 
 func (a *LeakoSensor) GetMQTTSignalHassConfig(baseTopic string) *HassDiscoveryPayload {
 	return &HassDiscoveryPayload{
-		Name:              fmt.Sprintf("%d", a.ID),
-		AvailabilityTopic: a.GetMQTTAvailabilityTopic(baseTopic),
-		DeviceClass:       "connectivity",
-		StateTopic:        a.GetMQTTStateTopic(baseTopic),
-		UniqueId:          fmt.Sprintf("%s_%d-signal", a.Ctl.GetMQTTHassNodeId(), a.ID),
-		ValueTemplate:     "{{ value_json.lost_signal | abs }}",
-		PayloadOff:        "1",
-		PayloadOn:         "0",
-		Device: HassDeviceDiscoveryPayload{
-			Name:         a.Ctl.GetMQTTHassNodeId(),
-			Manufacturer: MANUFACTURER,
-			Identifiers:  []string{a.Ctl.GetMQTTHassNodeId()},
-		},
+		Name:             a.GetName(),
+		Availability:     hassAvailability(baseTopic, a.GetMQTTAvailabilityTopic(baseTopic)),
+		AvailabilityMode: "all",
+		DeviceClass:      "connectivity",
+		StateTopic:       a.GetMQTTStateTopic(baseTopic),
+		UniqueId:         fmt.Sprintf("%s_%d-signal", a.Ctl.GetMQTTHassNodeId(), a.ID),
+		ValueTemplate:    "{{ value_json.lost_signal | abs }}",
+		PayloadOff:       "1",
+		PayloadOn:        "0",
+		Device:           a.GetMQTTHassDevice(),
 	}
 }
 
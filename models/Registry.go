@@ -0,0 +1,69 @@
+package models
+
+import (
+	"sort"
+	"sync"
+)
+
+// Registry is the thread-safe list of the known controllers
+type Registry struct {
+	mu   sync.RWMutex
+	ctls map[string]*AkwatekCtl
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		ctls: make(map[string]*AkwatekCtl),
+	}
+}
+
+func (r *Registry) Add(ctl *AkwatekCtl) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.ctls[ctl.GetIdentifier()] = ctl
+}
+
+func (r *Registry) Get(identifier string) (*AkwatekCtl, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	ctl, ok := r.ctls[identifier]
+	return ctl, ok
+}
+
+// CheckIn create the controller if not present or update its values,
+// created is true when the controller wasn't known
+func (r *Registry) CheckIn(v1 *ReqItekV1) (ctl *AkwatekCtl, created bool, err error) {
+	identifier := GetIdentifierFromMAC(v1.MacAddress)
+
+	r.mu.Lock()
+	ctl, ok := r.ctls[identifier]
+	if !ok {
+		defer r.mu.Unlock()
+		ctl, err = NewAkwatekCtl(v1)
+		if err != nil {
+			return nil, false, err
+		}
+		r.ctls[identifier] = ctl
+		return ctl, true, nil
+	}
+	r.mu.Unlock()
+
+	if err := ctl.Parse(v1); err != nil {
+		return nil, false, err
+	}
+	return ctl, false, nil
+}
+
+// List return the controllers sorted by identifier
+func (r *Registry) List() []*AkwatekCtl {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	ctls := make([]*AkwatekCtl, 0, len(r.ctls))
+	for _, ctl := range r.ctls {
+		ctls = append(ctls, ctl)
+	}
+	sort.Slice(ctls, func(i, j int) bool {
+		return ctls[i].GetIdentifier() < ctls[j].GetIdentifier()
+	})
+	return ctls
+}
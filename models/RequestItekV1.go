@@ -43,3 +43,14 @@ func (i *ReqItekV1) UnmarshalJSON(data []byte) error {
 	}
 	return nil
 }
+
+func (i *ReqItekV1) MarshalJSON() ([]byte, error) {
+	type Alias ReqItekV1
+	return json.Marshal(&struct {
+		MacAddress string `json:"MAC_address"`
+		*Alias
+	}{
+		MacAddress: i.MacAddress.String(),
+		Alias:      (*Alias)(i),
+	})
+}
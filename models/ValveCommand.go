@@ -0,0 +1,214 @@
+package models
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	VALVE_COMMAND_PENDING    string = "pending"
+	VALVE_COMMAND_SENT       string = "sent"
+	VALVE_COMMAND_CONFIRMED  string = "confirmed"
+	VALVE_COMMAND_FAILED     string = "failed"
+	VALVE_COMMAND_SUPERSEDED string = "superseded"
+	VALVE_COMMAND_SOURCE     string = "mqtt"
+	VALVE_COMMAND_POLICY     string = "policy:"
+	VALVE_COMMAND_HISTORY    int    = 20
+)
+
+// ValveCommand is a valve action followed from MQTT until the controller status confirm it,
+// Attempts is the number of responses that carried it, CheckIns the number of check-ins since the last one.
+// OverrideToken allow an opening refused by the interlock, it's never published.
+type ValveCommand struct {
+	ID            string      `json:"id"`
+	Action        ValveAction `json:"action"`
+	Source        string      `json:"source"`
+	Reason        string      `json:"reason,omitempty"`
+	Override      bool        `json:"override,omitempty"`
+	Status        string      `json:"status"`
+	Attempts      int         `json:"attempts"`
+	CheckIns      int         `json:"checkins"`
+	CreatedAt     time.Time   `json:"created_at"`
+	UpdatedAt     time.Time   `json:"updated_at"`
+	Error         string      `json:"error,omitempty"`
+	OverrideToken string      `json:"-"`
+}
+
+func NewValveCommand(action ValveAction, source string, reason string) *ValveCommand {
+	now := time.Now()
+	return &ValveCommand{
+		ID:        strconv.FormatInt(now.UnixNano(), 10),
+		Action:    action,
+		Source:    source,
+		Reason:    reason,
+		Status:    VALVE_COMMAND_PENDING,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+}
+
+// IsDone return true once the command is confirmed, failed or superseded
+func (c *ValveCommand) IsDone() bool {
+	return c.Status != VALVE_COMMAND_PENDING && c.Status != VALVE_COMMAND_SENT
+}
+
+// IsPolicy return true if the command is a closing of a shut-off policy, it always wins over the cloud
+func (c *ValveCommand) IsPolicy() bool {
+	return strings.HasPrefix(c.Source, VALVE_COMMAND_POLICY)
+}
+
+// with return a copy of the command in a new status, commands are shared with the publishers and never modified in place
+func (c *ValveCommand) with(status string, errMessage string) *ValveCommand {
+	command := *c
+	command.Status = status
+	command.Error = errMessage
+	command.UpdatedAt = time.Now()
+	return &command
+}
+
+func (c *ValveCommand) String() string {
+	return fmt.Sprintf("%s %s from %s %s (attempts=%d)", c.ID, c.Action.String(), c.Source, c.Status, c.Attempts)
+}
+
+func (c *ValveCommand) MarshalJSON() ([]byte, error) {
+	type Alias ValveCommand
+	alias := (*Alias)(c)
+
+	return json.Marshal(&struct {
+		*Alias
+		Action string `json:"action"`
+	}{
+		Alias:  alias,
+		Action: c.Action.String(),
+	})
+}
+
+func (c *ValveCommand) UnmarshalJSON(data []byte) error {
+	type Alias ValveCommand
+	aux := &struct {
+		*Alias
+		Action string `json:"action"`
+	}{
+		Alias: (*Alias)(c),
+	}
+	if err := json.Unmarshal(data, aux); err != nil {
+		return err
+	}
+	action, err := ParseValveAction(aux.Action)
+	if err != nil {
+		return err
+	}
+	c.Action = action
+	return nil
+}
+
+// ParseValveCommand return a pending command from the payload of the valve command topic,
+// OPEN or CLOSE in any case, or the JSON form {"action": "CLOSE", "source": "automation", "reason": "leak", "override_token": "..."}
+func ParseValveCommand(payload []byte) (*ValveCommand, error) {
+	payload = bytes.TrimSpace(payload)
+	if len(payload) == 0 {
+		return nil, fmt.Errorf("empty valve command")
+	}
+	if payload[0] != '{' {
+		action, err := ParseValveAction(string(payload))
+		if err != nil {
+			return nil, err
+		}
+		return NewValveCommand(action, VALVE_COMMAND_SOURCE, ""), nil
+	}
+
+	var request struct {
+		Action        string `json:"action"`
+		Source        string `json:"source"`
+		Reason        string `json:"reason"`
+		OverrideToken string `json:"override_token"`
+	}
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&request); err != nil {
+		return nil, fmt.Errorf("invalid valve command: %w", err)
+	}
+	action, err := ParseValveAction(request.Action)
+	if err != nil {
+		return nil, err
+	}
+	if request.Source == "" {
+		request.Source = VALVE_COMMAND_SOURCE
+	}
+	command := NewValveCommand(action, request.Source, request.Reason)
+	command.OverrideToken = request.OverrideToken
+	return command, nil
+}
+
+// ParseValveAction return the valve action of OPEN or CLOSE, case-insensitive
+func ParseValveAction(value string) (ValveAction, error) {
+	switch strings.ToUpper(strings.TrimSpace(value)) {
+	case "OPEN":
+		return VALVE_ACTION_OPEN, nil
+	case "CLOSE":
+		return VALVE_ACTION_CLOSE, nil
+	}
+	return "", fmt.Errorf("invalid valve action %q, expected OPEN or CLOSE", value)
+}
+
+// String return OPEN or CLOSE, like the payload of the valve command topic
+func (a ValveAction) String() string {
+	if a == VALVE_ACTION_OPEN {
+		return "OPEN"
+	}
+	return "CLOSE"
+}
+
+// ValveCommandHistory is the last done valve commands, most recent first
+type ValveCommandHistory []*ValveCommand
+
+func (h ValveCommandHistory) MarshalJSON() ([]byte, error) {
+	return json.Marshal([]*ValveCommand(h))
+}
+
+// ValveCommandRejection is published on the valve error topic when a command payload is refused
+type ValveCommandRejection struct {
+	Time    time.Time `json:"time"`
+	Payload string    `json:"payload"`
+	Error   string    `json:"error"`
+}
+
+func NewValveCommandRejection(payload []byte, err error) *ValveCommandRejection {
+	return &ValveCommandRejection{
+		Time:    time.Now(),
+		Payload: string(payload),
+		Error:   err.Error(),
+	}
+}
+
+func (r *ValveCommandRejection) MarshalJSON() ([]byte, error) {
+	type Alias ValveCommandRejection
+	alias := (*Alias)(r)
+
+	return json.Marshal(&struct {
+		*Alias
+	}{
+		Alias: alias,
+	})
+}
+
+// ValveOverride is the time-limited token allowing one opening of the valve refused by the interlock
+type ValveOverride struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+func (o *ValveOverride) MarshalJSON() ([]byte, error) {
+	type Alias ValveOverride
+	alias := (*Alias)(o)
+
+	return json.Marshal(&struct {
+		*Alias
+	}{
+		Alias: alias,
+	})
+}
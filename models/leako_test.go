@@ -0,0 +1,87 @@
+package models
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDryRunValveState(t *testing.T) {
+	mac := "bc:ff:4d:00:00:01"
+	ctl, err := NewAkwatekCtl(newReqItekV1(t, mac, "18041"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctl.SetDryRun(true)
+	ctl.QueueValveCommand(NewValveCommand(VALVE_ACTION_CLOSE, VALVE_COMMAND_SOURCE, ""))
+	ctl.TakeValveCommand()
+
+	tests := []struct {
+		status string
+		state  string
+		valve  bool
+	}{
+		// the simulated valve is closed, the controller still report it open
+		{"18041", "closed", true},
+		{"18041", "closed", true},
+		// the valve bit is followed again once it change, the controller can move the valve itself
+		{"18040", "closed", false},
+		{"18041", "open", true},
+		{"18140", "closed", false},
+	}
+	for i, test := range tests {
+		if err := ctl.Parse(newReqItekV1(t, mac, test.status)); err != nil {
+			t.Fatal(err)
+		}
+		ctl.CheckValveCommand(2, 3)
+		if state := ctl.ValveState(); state != test.state {
+			t.Errorf("check-in %d: got %q, expected %q", i+1, state, test.state)
+		}
+		if ctl.IsValveOpen() != test.valve || ctl.IsSimulatedValveOpen() != (test.state == "open") {
+			t.Errorf("check-in %d: got valve %t and simulated valve %t", i+1, ctl.IsValveOpen(), ctl.IsSimulatedValveOpen())
+		}
+		data, err := json.Marshal(ctl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var state struct {
+			Valve          bool  `json:"valve"`
+			SimulatedValve *bool `json:"simulated_valve"`
+		}
+		if err := json.Unmarshal(data, &state); err != nil {
+			t.Fatal(err)
+		}
+		if state.Valve != test.valve || state.SimulatedValve == nil || *state.SimulatedValve != (test.state == "open") {
+			t.Errorf("check-in %d: unexpected state %s", i+1, data)
+		}
+	}
+}
+
+// TestIDChange check the ID of the requests, whose meaning is unknown, isn't used as a version of the device
+func TestIDChange(t *testing.T) {
+	mac := "bc:ff:4d:00:00:01"
+	ctl, err := NewAkwatekCtl(newReqItekV1(t, mac, "18041"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctl.SetLastHassConfigPublished(time.Now())
+	v1 := newReqItekV1(t, mac, "18041")
+	v1.ID = "1213"
+	if err := ctl.Parse(v1); err != nil {
+		t.Fatal(err)
+	}
+	if !ctl.IsHassConfigPublished() {
+		t.Errorf("discovery published again when the ID change")
+	}
+	data, err := json.Marshal(ctl.GetMQTTHassDevice())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "sw_version") {
+		t.Errorf("ID published as the version of the device %s", data)
+	}
+	if diagnostics := ctl.GetDiagnostics(); diagnostics.ID != "1213" {
+		t.Errorf("got ID %q in the diagnostics, expected 1213", diagnostics.ID)
+	}
+}
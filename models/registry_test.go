@@ -0,0 +1,196 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func newReqItekV1(t *testing.T, mac string, status string) *ReqItekV1 {
+	t.Helper()
+	hardwareAddr, err := net.ParseMAC(mac)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &ReqItekV1{
+		MacAddress: hardwareAddr,
+		ID:         "1.0",
+		CtlStatus:  status,
+		Zone01To25: "1191",
+	}
+}
+
+// TestRegistryConcurrentCheckIns is meant to run with -race, the check-ins, the MQTT commands
+// and the publishers of several controllers touch the registry at the same time
+func TestRegistryConcurrentCheckIns(t *testing.T) {
+	registry := NewRegistry()
+	macs := []string{"bc:ff:4d:00:00:01", "bc:ff:4d:00:00:02", "bc:ff:4d:00:00:03"}
+
+	var wg sync.WaitGroup
+	for worker := 0; worker < 8; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				mac := macs[(worker+i)%len(macs)]
+				// the valve bit move so the sent commands get confirmed
+				ctl, _, err := registry.CheckIn(newReqItekV1(t, mac, fmt.Sprintf("1804%d", i%2)))
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				ctl.CheckValveCommand(2, 3)
+				ctl.TakeValveCommand()
+				ctl.QueueValveCommand(NewValveCommand(VALVE_ACTION_CLOSE, VALVE_COMMAND_SOURCE, ""))
+				if _, err := json.Marshal(ctl); err != nil {
+					t.Error(err)
+				}
+				if _, err := json.Marshal(ctl.Snapshot()); err != nil {
+					t.Error(err)
+				}
+				for _, sensor := range ctl.GetSensors() {
+					if _, err := json.Marshal(sensor); err != nil {
+						t.Error(err)
+					}
+				}
+				registry.List()
+			}
+		}(worker)
+	}
+	wg.Wait()
+
+	if ctls := registry.List(); len(ctls) != len(macs) {
+		t.Errorf("got %d controllers, expected %d", len(ctls), len(macs))
+	}
+}
+
+// TestValveCommandHandoff check a command queued during a check-in is sent exactly once,
+// it's taken by one check-in or superseded before being sent, never dropped nor sent twice
+func TestValveCommandHandoff(t *testing.T) {
+	registry := NewRegistry()
+	mac := "bc:ff:4d:00:00:01"
+	ctl, _, err := registry.CheckIn(newReqItekV1(t, mac, "18041"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const commands = 2000
+	var mu sync.Mutex
+	taken := map[string]int{}
+	superseded := map[string]*ValveCommand{}
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	for worker := 0; worker < 4; worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				if _, _, err := registry.CheckIn(newReqItekV1(t, mac, "18041")); err != nil {
+					t.Error(err)
+					return
+				}
+				// never sent again, a second take of a command would be a duplicate
+				ctl.CheckValveCommand(math.MaxInt, math.MaxInt)
+				if command := ctl.TakeValveCommand(); command != nil {
+					mu.Lock()
+					taken[command.ID]++
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+
+	var queueWg sync.WaitGroup
+	for worker := 0; worker < 4; worker++ {
+		queueWg.Add(1)
+		go func(worker int) {
+			defer queueWg.Done()
+			for i := worker; i < commands; i += 4 {
+				command := NewValveCommand(VALVE_ACTION_CLOSE, VALVE_COMMAND_SOURCE, "")
+				command.ID = fmt.Sprintf("%d", i)
+				if previous := ctl.QueueValveCommand(command); previous != nil {
+					mu.Lock()
+					superseded[previous.ID] = previous
+					mu.Unlock()
+				}
+			}
+		}(worker)
+	}
+	queueWg.Wait()
+	close(done)
+	wg.Wait()
+
+	if command := ctl.TakeValveCommand(); command != nil {
+		taken[command.ID]++
+	}
+	for i := 0; i < commands; i++ {
+		id := fmt.Sprintf("%d", i)
+		unsent := superseded[id] != nil && superseded[id].Attempts == 0
+		switch {
+		case taken[id] > 1:
+			t.Errorf("command %s sent %d times", id, taken[id])
+		case taken[id] == 1 && unsent:
+			t.Errorf("command %s sent and superseded as never sent", id)
+		case taken[id] == 0 && !unsent:
+			t.Errorf("command %s dropped", id)
+		}
+	}
+}
+
+// TestConcurrentCheckInsKeepSensors check two check-ins of a controller are never parsed from the same sensors:
+// every check-in pair a different zone and unpair the others, the unpaired sensors are kept as removed,
+// so every zone must be known at the end and a check-in never forget a sensor of the previous one
+func TestConcurrentCheckInsKeepSensors(t *testing.T) {
+	registry := NewRegistry()
+	mac := "bc:ff:4d:00:00:01"
+	const zones = 25
+	ctl, _, err := registry.CheckIn(newReqItekV1(t, mac, "18041"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for worker := 0; worker < zones; worker++ {
+		wg.Add(1)
+		go func(zone int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				v1 := newReqItekV1(t, mac, "18041")
+				raw := []byte(strings.Repeat("0", zones))
+				raw[zone] = '1'
+				v1.Zone01To25 = string(raw)
+				if _, _, err := registry.CheckIn(v1); err != nil {
+					t.Error(err)
+					return
+				}
+				ctl.mu.RLock()
+				for id := range ctl.previousSensors {
+					if _, ok := ctl.sensors[id]; !ok {
+						t.Errorf("sensor %d of the previous check-in lost", id)
+					}
+				}
+				ctl.mu.RUnlock()
+			}
+		}(worker)
+	}
+	wg.Wait()
+
+	if sensors := ctl.GetSensors(); len(sensors) != zones {
+		t.Errorf("got %d sensors, expected %d", len(sensors), zones)
+	}
+	ctl.mu.RLock()
+	defer ctl.mu.RUnlock()
+	if len(ctl.previousSensors) != zones {
+		t.Errorf("got %d sensors in the previous check-in, expected %d", len(ctl.previousSensors), zones)
+	}
+}
@@ -4,99 +4,318 @@ import (
 	"akwatek-mqtt-bridge/models"
 	"akwatek-mqtt-bridge/utils"
 	"encoding/json"
-	"fmt"
-	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"github.com/rs/zerolog/log"
+	"strings"
+	"sync"
 	"time"
 )
 
+// Message is a message received on a watched topic,
+// ResponseTopic and CorrelationData are only set by a MQTT v5 sender
+type Message struct {
+	Topic           string
+	Payload         []byte
+	ResponseTopic   string
+	CorrelationData []byte
+}
+
+// Properties of a publication, ignored by the MQTT 3.1.1 backend
+type Properties struct {
+	MessageExpiry   time.Duration
+	UserProperties  map[string]string
+	CorrelationData []byte
+}
+
+// backend is the MQTT protocol implementation used by the Client
+type backend interface {
+	Publish(topic string, qos byte, retain bool, payload []byte, properties *Properties) error
+	Subscribe(topic string, qos byte) error
+	Disconnect()
+}
+
 type Client struct {
-	config         *utils.ConfigMQTT
-	instance       mqtt.Client
-	baseTopic      string
-	onConnectWatch map[string]chan bool
+	config        *utils.ConfigMQTT
+	backend       backend
+	ready         chan struct{}
+	baseTopic     string
+	mu            sync.Mutex
+	connected     bool
+	subscriptions map[string]func(*Message)
+	connectHooks  []func()
+	messages      chan *Message
 }
 
 func NewMQTT(config *utils.Config) *Client {
-	opts := mqtt.NewClientOptions()
-	opts.AddBroker(fmt.Sprintf("tcp://%s:%d", config.MQTT.BrokerHost, config.MQTT.BrokerPort))
-	opts.SetClientID(config.MQTT.ClientID)
-	opts.SetUsername(config.MQTT.Username)
-	opts.SetPassword(config.MQTT.Password)
-
-	onConnectWatch := make(map[string]chan bool, 1)
-	opts.OnConnect = func(client mqtt.Client) {
-		log.Info().Msg("MQTT Connected")
-		for _, onConnectChan := range onConnectWatch {
-			onConnectChan <- true
-		}
+	c := &Client{
+		config:        config.MQTT,
+		ready:         make(chan struct{}),
+		baseTopic:     config.MQTT.BaseTopic,
+		subscriptions: make(map[string]func(*Message)),
+		messages:      make(chan *Message, 100),
 	}
-	opts.OnConnectionLost = func(client mqtt.Client, err error) {
-		log.Err(err).Msgf("MQTT broker connection lost")
+	go c.handle()
+
+	tlsConfig, err := utils.MQTTTLSConfig(config.MQTT)
+	if err != nil {
+		panic(err)
 	}
 
-	opts.ConnectRetryInterval = 5 * time.Second
+	switch config.MQTT.Version {
+	case utils.MQTT_VERSION_5:
+		c.backend, err = newV5Backend(config.MQTT, tlsConfig, c.onConnect, c.onConnectionLost, c.dispatch)
+	default:
+		c.backend, err = newV3Backend(config.MQTT, tlsConfig, c.onConnect, c.onConnectionLost, c.dispatch)
+	}
+	if err != nil {
+		panic(err)
+	}
+	// both backends call onConnect in a goroutine, it can start before the backend is assigned
+	close(c.ready)
 
-	client := mqtt.NewClient(opts)
-	if token := client.Connect(); token.Wait() && token.Error() != nil {
-		panic(token.Error())
+	return c
+}
+
+func (c *Client) onConnect() {
+	<-c.ready
+	log.Info().Msg("MQTT Connected")
+	c.publishBridgeAvailability(true)
+	// subscriptions are lost with the connection
+	c.mu.Lock()
+	c.connected = true
+	for topicID := range c.subscriptions {
+		c.subscribe(topicID)
+	}
+	hooks := c.connectHooks
+	c.mu.Unlock()
+	for _, hook := range hooks {
+		hook()
 	}
+}
+
+// OnConnect run the callback on every re-connection, after the subscriptions are renewed
+func (c *Client) OnConnect(callback func()) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.connectHooks = append(c.connectHooks, callback)
+}
 
-	return &Client{
-		config:         config.MQTT,
-		instance:       client,
-		baseTopic:      config.MQTT.BaseTopic,
-		onConnectWatch: onConnectWatch,
+func (c *Client) onConnectionLost(err error) {
+	log.Err(err).Msgf("MQTT broker connection lost")
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.connected = false
+}
+
+// dispatch queue a received message for handle, so its callback can publish without blocking the backend
+func (c *Client) dispatch(message *Message) {
+	c.messages <- message
+}
+
+// handle give the received messages to the callback of their topic one at a time, in the order they were received,
+// so a valve command is never overtaken by the next one
+func (c *Client) handle() {
+	for message := range c.messages {
+		c.mu.Lock()
+		handler, ok := c.subscriptions[message.Topic]
+		c.mu.Unlock()
+		if !ok {
+			log.Debug().Msgf("ignoring message of topic %s", message.Topic)
+			continue
+		}
+		handler(message)
+	}
+}
+
+func (c *Client) publishBridgeAvailability(online bool) {
+	payload := "online"
+	if !online {
+		payload = "offline"
+	}
+	c.publish("BridgeAvailability", models.GetMQTTBridgeAvailabilityTopic(c.baseTopic),
+		&utils.ConfigMQTTPublish{QoS: 1, Retain: true}, []byte(payload), nil)
+}
+
+// Close set the bridge offline and disconnect from the broker
+func (c *Client) Close() {
+	c.publishBridgeAvailability(false)
+	c.backend.Disconnect()
+}
+
+func (c *Client) subscribe(topicID string) {
+	if err := c.backend.Subscribe(topicID, c.config.CommandQoS); err != nil {
+		log.Error().Err(err).Msgf("failed to subscribe to topic %s", topicID)
+		return
 	}
+	log.Info().Msgf("Subscribed to topic: %s", topicID)
+}
+
+// WatchValve subscribe to the valve command topic, the subscription is renewed on every re-connection
+func (c *Client) WatchValve(topicID string, callback func(payload []byte) json.Marshaler) {
+	// https://www.home-assistant.io/integrations/valve.mqtt/
+	c.WatchCommand(topicID, callback)
 }
 
-func (c *Client) WatchValve(topicID string, callback func(action models.ValveAction)) {
-	c.onConnectWatch[topicID] = make(chan bool)
-	for {
-		// https://www.home-assistant.io/integrations/button.mqtt/
-		token := c.instance.Subscribe(topicID, 1, func(client mqtt.Client, message mqtt.Message) {
-			value := string(message.Payload())
-			if value == "OPEN" {
-				callback(models.VALVE_ACTION_OPEN)
-			} else {
-				callback(models.VALVE_ACTION_CLOSE)
-			}
-		})
-		token.WaitTimeout(5 * time.Second)
-		if !token.WaitTimeout(2 * time.Second) {
-			log.Warn().Msgf("timeout to subscribe to topic %s", topicID)
+// WatchCommand subscribe to a command topic,
+// the result of the callback is sent back on the response topic of a MQTT v5 command
+func (c *Client) WatchCommand(topicID string, callback func(payload []byte) json.Marshaler) {
+	c.watch(topicID, func(message *Message) {
+		c.Reply(message, callback(message.Payload))
+	})
+}
+
+// WatchHassStatus subscribe to the birth and last will messages of Home Assistant
+func (c *Client) WatchHassStatus(topicID string, callback func(online bool)) {
+	// https://www.home-assistant.io/integrations/mqtt/#birth-and-last-will-messages
+	c.watch(topicID, func(message *Message) {
+		switch string(message.Payload) {
+		case "online":
+			callback(true)
+		case "offline":
+			callback(false)
 		}
-		if token.Error() != nil {
-			log.Error().Err(token.Error()).Msgf("failed to subscribe to topic %s", topicID)
+	})
+}
+
+// WatchSwitch subscribe to the command topic of a switch, ON or OFF in any case
+func (c *Client) WatchSwitch(topicID string, callback func(on bool)) {
+	// https://www.home-assistant.io/integrations/switch.mqtt/
+	c.watch(topicID, func(message *Message) {
+		switch strings.ToUpper(strings.TrimSpace(string(message.Payload))) {
+		case "ON":
+			callback(true)
+		case "OFF":
+			callback(false)
+		default:
+			log.Warn().Msgf("ignoring switch command %q on topic %s, expected ON or OFF", message.Payload, topicID)
 		}
-		log.Info().Msgf("Subscribed to topic: %s", topicID)
-		// wait for re-connection
-		<-c.onConnectWatch[topicID]
+	})
+}
+
+func (c *Client) watch(topicID string, handler func(*Message)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.subscriptions[topicID]; ok {
+		return
+	}
+	c.subscriptions[topicID] = handler
+	if c.connected {
+		c.subscribe(topicID)
 	}
 }
 
-func (c *Client) PublishState(topic string, payload json.Marshaler) {
-	log.Debug().Msgf("PublishState to topic: %s", topic)
+// Reply publish on the response topic of the message with its correlation data, if the sender asked for it
+func (c *Client) Reply(message *Message, payload json.Marshaler) {
+	if message.ResponseTopic == "" {
+		return
+	}
 	jsonPayload, err := json.Marshal(payload)
 	if err != nil {
-		log.Error().Err(err).Msgf("failed to marshall %s", topic)
+		log.Error().Err(err).Msgf("failed to marshall %s", message.ResponseTopic)
+		return
 	}
-	token := c.instance.Publish(topic, 0, false, jsonPayload)
-	if !token.WaitTimeout(2 * time.Second) {
-		log.Warn().Msgf("timeout to publish state to topic %s", topic)
+	c.publish("Reply", message.ResponseTopic, &utils.ConfigMQTTPublish{QoS: 1}, jsonPayload, &Properties{
+		CorrelationData: message.CorrelationData,
+	})
+}
+
+func (c *Client) publish(kind string, topic string, publish *utils.ConfigMQTTPublish, payload []byte, properties *Properties) {
+	log.Debug().Msgf("Publish%s to topic: %s", kind, topic)
+	if err := c.backend.Publish(topic, publish.QoS, publish.Retain, payload, properties); err != nil {
+		log.Error().Err(err).Msgf("failed to publish %s to topic %s", strings.ToLower(kind), topic)
 	}
-	if token.Error() != nil {
-		log.Error().Err(token.Error()).Msgf("failed to publish state to topic %s", topic)
+}
+
+func (c *Client) publishJSON(kind string, topic string, publish *utils.ConfigMQTTPublish, payload json.Marshaler, properties *Properties) {
+	jsonPayload, err := json.Marshal(payload)
+	if err != nil {
+		log.Error().Err(err).Msgf("failed to marshall %s", topic)
+		return
 	}
+	c.publish(kind, topic, publish, jsonPayload, properties)
+}
+
+// PublishDiscovery publish discovery config, retained by default so a restarted Home Assistant get them back
+func (c *Client) PublishDiscovery(topic string, payload json.Marshaler) {
+	c.publishJSON("Discovery", topic, c.config.Discovery, payload, nil)
+}
+
+// PublishState publish the state of a controller, it expires after the configured delay with MQTT v5
+func (c *Client) PublishState(topic string, payload json.Marshaler, userProperties map[string]string) {
+	c.publishJSON("State", topic, c.config.State, payload, &Properties{
+		MessageExpiry:  c.config.StateExpiry,
+		UserProperties: userProperties,
+	})
+}
+
+// PublishDiagnostics publish the diagnostics of a controller, they never expire so the last check-in stays known
+func (c *Client) PublishDiagnostics(topic string, payload json.Marshaler, userProperties map[string]string) {
+	c.publishJSON("Diagnostics", topic, c.config.State, payload, &Properties{
+		UserProperties: userProperties,
+	})
 }
 
-func (c *Client) PublishAvailability(topicID string) {
-	log.Debug().Msgf("PublishAvailability to topic: %s", topicID)
-	token := c.instance.Publish(topicID, 0, false, "online")
-	if !token.WaitTimeout(2 * time.Second) {
-		log.Warn().Msgf("timeout to publish availability to topic %s", topicID)
+// PublishLeakState publish the state of a leak sensor, QoS 1 and retained by default so an alarm isn't lost
+func (c *Client) PublishLeakState(topic string, payload json.Marshaler, userProperties map[string]string) {
+	c.publishJSON("LeakState", topic, c.config.LeakState, payload, &Properties{
+		MessageExpiry:  c.config.StateExpiry,
+		UserProperties: userProperties,
+	})
+}
+
+func (c *Client) PublishEvent(topic string, payload json.Marshaler, userProperties map[string]string) {
+	c.publishJSON("Event", topic, c.config.Events, payload, &Properties{
+		UserProperties: userProperties,
+	})
+}
+
+// PublishValveResult publish a valve command on every step of its lifecycle
+func (c *Client) PublishValveResult(topic string, payload json.Marshaler, userProperties map[string]string) {
+	c.publishJSON("ValveResult", topic, c.config.ValveResult, payload, &Properties{
+		UserProperties: userProperties,
+	})
+}
+
+// PublishValveHistory publish the last done valve commands, always retained
+func (c *Client) PublishValveHistory(topic string, payload json.Marshaler) {
+	c.publishJSON("ValveHistory", topic, &utils.ConfigMQTTPublish{QoS: c.config.ValveResult.QoS, Retain: true}, payload, nil)
+}
+
+// PublishValveOverride publish the override token of the valve interlock
+func (c *Client) PublishValveOverride(topic string, payload json.Marshaler, userProperties map[string]string) {
+	c.publishJSON("ValveOverride", topic, c.config.Events, payload, &Properties{
+		UserProperties: userProperties,
+	})
+}
+
+// PublishValveError publish a refused valve command
+func (c *Client) PublishValveError(topic string, payload json.Marshaler, userProperties map[string]string) {
+	c.publishJSON("ValveError", topic, c.config.Events, payload, &Properties{
+		UserProperties: userProperties,
+	})
+}
+
+func (c *Client) PublishSwitchState(topicID string, on bool) {
+	payload := "ON"
+	if !on {
+		payload = "OFF"
 	}
-	if token.Error() != nil {
-		log.Error().Err(token.Error()).Msgf("failed to publish availability to topic %s", topicID)
+	c.publish("SwitchState", topicID, c.config.State, []byte(payload), nil)
+}
+
+func (c *Client) PublishAvailability(topicID string, online bool) {
+	payload := "online"
+	if !online {
+		payload = "offline"
 	}
+	c.publish("Availability", topicID, c.config.Availability, []byte(payload), nil)
+}
+
+// PublishHomie publish a Homie attribute or property value, always QoS 1 and retained as required by the convention
+func (c *Client) PublishHomie(topic string, value string) {
+	c.publish("Homie", topic, &utils.ConfigMQTTPublish{QoS: 1, Retain: true}, []byte(value), nil)
+}
+
+// ClearRetained remove the retained message of a topic, like a discovery config of a removed entity
+func (c *Client) ClearRetained(topic string) {
+	c.publish("ClearRetained", topic, &utils.ConfigMQTTPublish{QoS: 1, Retain: true}, []byte{}, nil)
 }
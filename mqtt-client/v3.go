@@ -0,0 +1,70 @@
+package mqtt_client
+
+import (
+	"akwatek-mqtt-bridge/models"
+	"akwatek-mqtt-bridge/utils"
+	"crypto/tls"
+	"fmt"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"time"
+)
+
+// v3Backend is the MQTT 3.1.1 backend
+type v3Backend struct {
+	instance  mqtt.Client
+	onMessage func(*Message)
+}
+
+func newV3Backend(config *utils.ConfigMQTT, tlsConfig *tls.Config, onConnect func(), onConnectionLost func(error), onMessage func(*Message)) (*v3Backend, error) {
+	b := &v3Backend{onMessage: onMessage}
+
+	opts := mqtt.NewClientOptions()
+	opts.AddBroker(config.BrokerURL)
+	// only used by the ssl, mqtts and wss schemes
+	opts.SetTLSConfig(tlsConfig)
+	opts.SetClientID(config.ClientID)
+	opts.SetUsername(config.Username)
+	opts.SetPassword(config.Password)
+	// the broker set the bridge offline if the connection is lost
+	opts.SetWill(models.GetMQTTBridgeAvailabilityTopic(config.BaseTopic), "offline", 1, true)
+
+	opts.OnConnect = func(client mqtt.Client) {
+		onConnect()
+	}
+	opts.OnConnectionLost = func(client mqtt.Client, err error) {
+		onConnectionLost(err)
+	}
+
+	opts.ConnectRetryInterval = 5 * time.Second
+
+	b.instance = mqtt.NewClient(opts)
+	if token := b.instance.Connect(); token.Wait() && token.Error() != nil {
+		return nil, token.Error()
+	}
+	return b, nil
+}
+
+func (b *v3Backend) Publish(topic string, qos byte, retain bool, payload []byte, properties *Properties) error {
+	token := b.instance.Publish(topic, qos, retain, payload)
+	if !token.WaitTimeout(2 * time.Second) {
+		return fmt.Errorf("timeout")
+	}
+	return token.Error()
+}
+
+func (b *v3Backend) Subscribe(topic string, qos byte) error {
+	token := b.instance.Subscribe(topic, qos, func(client mqtt.Client, message mqtt.Message) {
+		b.onMessage(&Message{
+			Topic:   message.Topic(),
+			Payload: message.Payload(),
+		})
+	})
+	if !token.WaitTimeout(5 * time.Second) {
+		return fmt.Errorf("timeout")
+	}
+	return token.Error()
+}
+
+func (b *v3Backend) Disconnect() {
+	b.instance.Disconnect(1000)
+}
@@ -0,0 +1,131 @@
+package mqtt_client
+
+import (
+	"akwatek-mqtt-bridge/models"
+	"akwatek-mqtt-bridge/utils"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/rs/zerolog/log"
+	"net/url"
+	"sort"
+	"time"
+)
+
+// v5Backend is the MQTT v5 backend, it support message expiry, user properties, response topics and correlation data
+type v5Backend struct {
+	cm *autopaho.ConnectionManager
+}
+
+func newV5Backend(config *utils.ConfigMQTT, tlsConfig *tls.Config, onConnect func(), onConnectionLost func(error), onMessage func(*Message)) (*v5Backend, error) {
+	brokerURL, err := url.Parse(config.BrokerURL)
+	if err != nil {
+		return nil, err
+	}
+
+	clientConfig := autopaho.ClientConfig{
+		ServerUrls:                    []*url.URL{brokerURL},
+		TlsCfg:                        tlsConfig,
+		KeepAlive:                     30,
+		CleanStartOnInitialConnection: true,
+		ConnectRetryDelay:             5 * time.Second,
+		ConnectUsername:               config.Username,
+		ConnectPassword:               []byte(config.Password),
+		// the broker set the bridge offline if the connection is lost, without will delay
+		WillMessage: &paho.WillMessage{
+			Topic:   models.GetMQTTBridgeAvailabilityTopic(config.BaseTopic),
+			Payload: []byte("offline"),
+			QoS:     1,
+			Retain:  true,
+		},
+		OnConnectionUp: func(cm *autopaho.ConnectionManager, connack *paho.Connack) {
+			// onConnect subscribe through the connection manager, it must not block this callback
+			go onConnect()
+		},
+		OnConnectError: func(err error) {
+			log.Error().Err(err).Msg("MQTT connection failed")
+		},
+		ClientConfig: paho.ClientConfig{
+			ClientID: config.ClientID,
+			OnPublishReceived: []func(paho.PublishReceived) (bool, error){
+				func(received paho.PublishReceived) (bool, error) {
+					message := &Message{
+						Topic:   received.Packet.Topic,
+						Payload: received.Packet.Payload,
+					}
+					if received.Packet.Properties != nil {
+						message.ResponseTopic = received.Packet.Properties.ResponseTopic
+						message.CorrelationData = received.Packet.Properties.CorrelationData
+					}
+					onMessage(message)
+					return true, nil
+				},
+			},
+			OnClientError: onConnectionLost,
+			OnServerDisconnect: func(disconnect *paho.Disconnect) {
+				onConnectionLost(fmt.Errorf("server disconnected, reason code %d", disconnect.ReasonCode))
+			},
+		},
+	}
+
+	cm, err := autopaho.NewConnection(context.Background(), clientConfig)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := cm.AwaitConnection(ctx); err != nil {
+		return nil, err
+	}
+	return &v5Backend{cm: cm}, nil
+}
+
+func (b *v5Backend) Publish(topic string, qos byte, retain bool, payload []byte, properties *Properties) error {
+	publish := &paho.Publish{
+		Topic:   topic,
+		QoS:     qos,
+		Retain:  retain,
+		Payload: payload,
+	}
+	if properties != nil {
+		publish.Properties = &paho.PublishProperties{
+			CorrelationData: properties.CorrelationData,
+			ContentType:     "application/json",
+		}
+		if properties.MessageExpiry > 0 {
+			expiry := uint32(properties.MessageExpiry.Seconds())
+			publish.Properties.MessageExpiry = &expiry
+		}
+		keys := make([]string, 0, len(properties.UserProperties))
+		for key := range properties.UserProperties {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			publish.Properties.User.Add(key, properties.UserProperties[key])
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	_, err := b.cm.Publish(ctx, publish)
+	return err
+}
+
+func (b *v5Backend) Subscribe(topic string, qos byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := b.cm.Subscribe(ctx, &paho.Subscribe{
+		Subscriptions: []paho.SubscribeOptions{
+			{Topic: topic, QoS: qos},
+		},
+	})
+	return err
+}
+
+func (b *v5Backend) Disconnect() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	b.cm.Disconnect(ctx)
+}
@@ -0,0 +1,276 @@
+package notify
+
+import (
+	"akwatek-mqtt-bridge/models"
+	"akwatek-mqtt-bridge/sink"
+	"akwatek-mqtt-bridge/utils"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"slices"
+	"text/template"
+	"time"
+)
+
+const (
+	DEFAULT_BODY         string        = "{{ json . }}"
+	DEFAULT_MAX_ATTEMPTS int           = 10
+	DEFAULT_BACKOFF      time.Duration = 10 * time.Second
+	DEFAULT_MAX_BACKOFF  time.Duration = 10 * time.Minute
+)
+
+// defaultBody is the body sent when the template of a webhook fail, so an alert is never dropped
+var defaultBody = template.Must(template.New("default").Funcs(template.FuncMap{"json": toJSON}).Parse(DEFAULT_BODY))
+
+// Webhook send the events of its types to an URL, with a body rendered from the event
+type Webhook struct {
+	name        string
+	events      []string
+	body        *template.Template
+	post        *sink.Webhook
+	maxAttempts int
+	backoff     time.Duration
+	maxBackoff  time.Duration
+}
+
+func NewWebhook(notification *utils.ConfigNotification) (*Webhook, error) {
+	if notification.Name == "" {
+		return nil, fmt.Errorf("missing name")
+	}
+	for _, event := range notification.Events {
+		if !slices.Contains(models.EVENT_TYPES, event) {
+			return nil, fmt.Errorf("unknown event %q", event)
+		}
+	}
+	body := notification.Body
+	if body == "" {
+		body = DEFAULT_BODY
+	}
+	tmpl, err := template.New(notification.Name).Funcs(template.FuncMap{"json": toJSON}).Parse(body)
+	if err != nil {
+		return nil, fmt.Errorf("invalid body: %w", err)
+	}
+	post, err := sink.NewWebhook(notification.Name, &utils.ConfigSink{
+		URL:     notification.URL,
+		Timeout: notification.Timeout,
+		Headers: notification.Headers,
+	})
+	if err != nil {
+		return nil, err
+	}
+	webhook := &Webhook{
+		name:        notification.Name,
+		events:      notification.Events,
+		body:        tmpl,
+		post:        post,
+		maxAttempts: notification.MaxAttempts,
+		backoff:     notification.Backoff,
+		maxBackoff:  notification.MaxBackoff,
+	}
+	if webhook.maxAttempts <= 0 {
+		webhook.maxAttempts = DEFAULT_MAX_ATTEMPTS
+	}
+	if webhook.backoff <= 0 {
+		webhook.backoff = DEFAULT_BACKOFF
+	}
+	if webhook.maxBackoff <= 0 {
+		webhook.maxBackoff = DEFAULT_MAX_BACKOFF
+	}
+	return webhook, nil
+}
+
+func (w *Webhook) Name() string {
+	return w.name
+}
+
+// Accept return true if the webhook send the events of this type
+func (w *Webhook) Accept(eventType string) bool {
+	return len(w.events) == 0 || slices.Contains(w.events, eventType)
+}
+
+// Render return the JSON body of an event, the default body if the template of the webhook fail
+// or doesn't give valid JSON, like a value with a quote not escaped by the template
+func (w *Webhook) Render(event *models.Event) ([]byte, error) {
+	body, err := render(w.body, event)
+	if err == nil {
+		return body, nil
+	}
+	log.Warn().Err(err).Msgf("failed to render %s notification for webhook %s, sending the default body", event.Type, w.name)
+	return render(defaultBody, event)
+}
+
+func render(tmpl *template.Template, event *models.Event) ([]byte, error) {
+	body := bytes.Buffer{}
+	if err := tmpl.Execute(&body, event); err != nil {
+		return nil, err
+	}
+	if !json.Valid(body.Bytes()) {
+		return nil, fmt.Errorf("invalid JSON body %q", body.String())
+	}
+	return body.Bytes(), nil
+}
+
+// Backoff return the delay before the next attempt, doubled on every attempt up to the max backoff
+func (w *Webhook) Backoff(attempts int) time.Duration {
+	backoff := w.backoff
+	for i := 1; i < attempts && backoff < w.maxBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, w.maxBackoff)
+}
+
+// Notifier queue the events on disk for the webhooks and send them in the background,
+// the events of a webhook are sent in order, a failed one delay the next ones
+type Notifier struct {
+	webhooks map[string]*Webhook
+	queue    *Queue
+	wake     chan struct{}
+	done     chan struct{}
+	stopped  chan struct{}
+}
+
+func NewNotifier(notifications []*utils.ConfigNotification, dataDir string) (*Notifier, error) {
+	webhooks := map[string]*Webhook{}
+	for i, notification := range notifications {
+		webhook, err := NewWebhook(notification)
+		if err != nil {
+			return nil, fmt.Errorf("invalid notification #%d: %w", i+1, err)
+		}
+		if _, ok := webhooks[webhook.Name()]; ok {
+			return nil, fmt.Errorf("invalid notification #%d: duplicated name %q", i+1, webhook.Name())
+		}
+		webhooks[webhook.Name()] = webhook
+	}
+	queue, err := NewQueue(dataDir)
+	if err != nil {
+		return nil, err
+	}
+	n := &Notifier{
+		webhooks: webhooks,
+		queue:    queue,
+		wake:     make(chan struct{}, 1),
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	go n.run()
+	return n, nil
+}
+
+// Notify queue the event for every webhook of its type
+func (n *Notifier) Notify(event *models.Event) {
+	queued := false
+	for _, webhook := range n.webhooks {
+		if !webhook.Accept(event.Type) {
+			continue
+		}
+		body, err := webhook.Render(event)
+		if err != nil {
+			log.Error().Err(err).Msgf("failed to render %s notification for webhook %s", event.Type, webhook.Name())
+			continue
+		}
+		now := time.Now()
+		delivery := &Delivery{
+			Webhook:     webhook.Name(),
+			Event:       event.Type,
+			Body:        body,
+			Created:     now,
+			NextAttempt: now,
+		}
+		if err := n.queue.Push(delivery); err != nil {
+			log.Error().Err(err).Msgf("failed to queue %s notification for webhook %s", event.Type, webhook.Name())
+			continue
+		}
+		queued = true
+	}
+	if !queued {
+		return
+	}
+	select {
+	case n.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Close stop sending, the queued deliveries are sent on the next start
+func (n *Notifier) Close() error {
+	close(n.done)
+	<-n.stopped
+	return n.queue.Close()
+}
+
+func (n *Notifier) run() {
+	defer close(n.stopped)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		n.deliver(time.Now())
+		select {
+		case <-n.done:
+			return
+		case <-n.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// deliver send the deliveries that are due, a webhook is skipped after a delivery not due or failed to keep the order
+func (n *Notifier) deliver(now time.Time) {
+	deliveries, err := n.queue.List()
+	if err != nil {
+		log.Error().Err(err).Msg("failed to list queued notifications")
+		return
+	}
+	blocked := map[string]bool{}
+	for _, delivery := range deliveries {
+		select {
+		case <-n.done:
+			return
+		default:
+		}
+		webhook, ok := n.webhooks[delivery.Webhook]
+		if !ok {
+			log.Warn().Msgf("dropping %s notification of the unknown webhook %s", delivery.Event, delivery.Webhook)
+			n.delete(delivery)
+			continue
+		}
+		if blocked[webhook.Name()] || delivery.NextAttempt.After(now) {
+			blocked[webhook.Name()] = true
+			continue
+		}
+		delivery.Attempts++
+		if err := webhook.post.Post(delivery.Body); err != nil {
+			blocked[webhook.Name()] = true
+			if delivery.Attempts >= webhook.maxAttempts {
+				log.Error().Err(err).Msgf("dropping %s notification for webhook %s after %d attempts", delivery.Event, webhook.Name(), delivery.Attempts)
+				n.delete(delivery)
+				continue
+			}
+			backoff := webhook.Backoff(delivery.Attempts)
+			log.Warn().Err(err).Msgf("failed to send %s notification to webhook %s, attempt %d/%d, retrying in %s",
+				delivery.Event, webhook.Name(), delivery.Attempts, webhook.maxAttempts, backoff)
+			delivery.NextAttempt = now.Add(backoff)
+			if err := n.queue.Update(delivery); err != nil {
+				log.Error().Err(err).Msgf("failed to update %s notification for webhook %s", delivery.Event, webhook.Name())
+			}
+			continue
+		}
+		log.Info().Msgf("%s notification sent to webhook %s", delivery.Event, webhook.Name())
+		n.delete(delivery)
+	}
+}
+
+func (n *Notifier) delete(delivery *Delivery) {
+	if err := n.queue.Delete(delivery.ID); err != nil {
+		log.Error().Err(err).Msgf("failed to delete %s notification for webhook %s", delivery.Event, delivery.Webhook)
+	}
+}
+
+// toJSON is the json function of the body templates, it return the value as JSON
+func toJSON(value interface{}) (string, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
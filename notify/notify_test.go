@@ -0,0 +1,182 @@
+package notify
+
+import (
+	"akwatek-mqtt-bridge/models"
+	"akwatek-mqtt-bridge/utils"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// server record the event of every request, and answer 500 to the first ones up to failures
+type server struct {
+	*httptest.Server
+	mu       sync.Mutex
+	failures int
+	received []string
+}
+
+func newServer(t *testing.T, failures int) *server {
+	s := &server{failures: failures}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Event string `json:"event"`
+		}
+		data, _ := io.ReadAll(r.Body)
+		if err := json.Unmarshal(data, &body); err != nil {
+			t.Errorf("invalid body %s: %v", data, err)
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.received = append(s.received, body.Event)
+		if len(s.received) <= s.failures {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *server) events() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.received)
+}
+
+// newNotifier return a notifier not sending in the background, the test call deliver itself
+func newNotifier(t *testing.T, dataDir string, notification *utils.ConfigNotification) *Notifier {
+	t.Helper()
+	webhook, err := NewWebhook(notification)
+	if err != nil {
+		t.Fatal(err)
+	}
+	queue, err := NewQueue(dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Notifier{
+		webhooks: map[string]*Webhook{webhook.Name(): webhook},
+		queue:    queue,
+		wake:     make(chan struct{}, 1),
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+}
+
+func newEvent(eventType string, message string) *models.Event {
+	return &models.Event{
+		Type:       eventType,
+		Time:       time.Now(),
+		Controller: "bc:ff:4d:00:00:01",
+		Message:    message,
+	}
+}
+
+func TestRenderFallback(t *testing.T) {
+	webhook, err := NewWebhook(&utils.ConfigNotification{
+		Name: "chat",
+		URL:  "http://localhost",
+		Body: `{"text": "{{ .Message }}"}`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := webhook.Render(newEvent(models.EVENT_LEAK_STARTED, "leak detected by sensor Water heater"))
+	if err != nil || string(body) != `{"text": "leak detected by sensor Water heater"}` {
+		t.Errorf("got (%s, %v), expected the body of the template", body, err)
+	}
+	// a zone name with a quote break the JSON of the template
+	body, err = webhook.Render(newEvent(models.EVENT_LEAK_STARTED, `leak detected by sensor 12" pipe`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var event models.Event
+	if err := json.Unmarshal(body, &event); err != nil || event.Type != models.EVENT_LEAK_STARTED {
+		t.Errorf("got %s, expected the default body", body)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	webhook := &Webhook{backoff: time.Second, maxBackoff: 5 * time.Second}
+	for attempts, expected := range []time.Duration{time.Second, time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second} {
+		if backoff := webhook.Backoff(attempts); backoff != expected {
+			t.Errorf("attempt %d: got %s, expected %s", attempts, backoff, expected)
+		}
+	}
+}
+
+func TestDeliverOrderAndRetries(t *testing.T) {
+	s := newServer(t, 3)
+	n := newNotifier(t, t.TempDir(), &utils.ConfigNotification{
+		Name:        "alerts",
+		URL:         s.URL,
+		MaxAttempts: 3,
+		Backoff:     time.Second,
+		MaxBackoff:  time.Minute,
+	})
+	defer n.queue.Close()
+	n.Notify(newEvent(models.EVENT_LEAK_STARTED, "leak"))
+	n.Notify(newEvent(models.EVENT_LEAK_CLEARED, "leak cleared"))
+	n.Notify(newEvent(models.EVENT_POWER_LOST, "power lost"))
+
+	start := time.Now()
+	tests := []struct {
+		after    time.Duration
+		received []string
+	}{
+		// the first one fail and block the next ones
+		{0, []string{models.EVENT_LEAK_STARTED}},
+		// not due yet, the backoff is 1s then 2s
+		{500 * time.Millisecond, []string{models.EVENT_LEAK_STARTED}},
+		{time.Second, []string{models.EVENT_LEAK_STARTED, models.EVENT_LEAK_STARTED}},
+		{2 * time.Second, []string{models.EVENT_LEAK_STARTED, models.EVENT_LEAK_STARTED}},
+		// dropped after 3 attempts
+		{3 * time.Second, []string{models.EVENT_LEAK_STARTED, models.EVENT_LEAK_STARTED, models.EVENT_LEAK_STARTED}},
+		// the next ones are sent in order
+		{4 * time.Second, []string{models.EVENT_LEAK_STARTED, models.EVENT_LEAK_STARTED, models.EVENT_LEAK_STARTED,
+			models.EVENT_LEAK_CLEARED, models.EVENT_POWER_LOST}},
+	}
+	for i, test := range tests {
+		n.deliver(start.Add(test.after))
+		if received := s.events(); !slices.Equal(received, test.received) {
+			t.Errorf("delivery %d: got %v, expected %v", i+1, received, test.received)
+		}
+	}
+	if deliveries, err := n.queue.List(); err != nil || len(deliveries) != 0 {
+		t.Errorf("got (%d deliveries, %v), expected an empty queue", len(deliveries), err)
+	}
+}
+
+func TestQueueSurviveRestart(t *testing.T) {
+	dataDir := t.TempDir()
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	n := newNotifier(t, dataDir, &utils.ConfigNotification{Name: "alerts", URL: down.URL})
+	n.Notify(newEvent(models.EVENT_LEAK_STARTED, "leak"))
+	n.Notify(newEvent(models.EVENT_ALARM_STARTED, "alarm"))
+	n.deliver(time.Now())
+	if err := n.queue.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s := newServer(t, 0)
+	n = newNotifier(t, dataDir, &utils.ConfigNotification{Name: "alerts", URL: s.URL})
+	defer n.queue.Close()
+	deliveries, err := n.queue.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deliveries) != 2 || deliveries[0].Attempts != 1 || deliveries[1].Attempts != 0 {
+		t.Fatalf("unexpected deliveries after restart %+v", deliveries)
+	}
+	n.deliver(deliveries[0].NextAttempt)
+	expected := []string{models.EVENT_LEAK_STARTED, models.EVENT_ALARM_STARTED}
+	if received := s.events(); !slices.Equal(received, expected) {
+		t.Errorf("got %v, expected %v", received, expected)
+	}
+}
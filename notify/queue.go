@@ -0,0 +1,110 @@
+package notify
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"go.etcd.io/bbolt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var deliveriesBucket = []byte("deliveries")
+
+// Delivery is a notification waiting for its webhook, kept on disk until it's accepted or out of attempts
+type Delivery struct {
+	ID          uint64          `json:"id"`
+	Webhook     string          `json:"webhook"`
+	Event       string          `json:"event"`
+	Body        json.RawMessage `json:"body"`
+	Attempts    int             `json:"attempts"`
+	Created     time.Time       `json:"created"`
+	NextAttempt time.Time       `json:"next_attempt"`
+}
+
+// Queue keep the deliveries in an embedded key/value file, in the order they were pushed
+type Queue struct {
+	db *bbolt.DB
+}
+
+func NewQueue(dataDir string) (*Queue, error) {
+	if err := os.MkdirAll(dataDir, 0o750); err != nil {
+		return nil, err
+	}
+	db, err := bbolt.Open(filepath.Join(dataDir, "notifications.db"), 0o600, &bbolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bbolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(deliveriesBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Queue{db: db}, nil
+}
+
+// Push give an ID to the delivery and save it
+func (q *Queue) Push(delivery *Delivery) error {
+	return q.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(deliveriesBucket)
+		id, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		delivery.ID = id
+		return put(bucket, delivery)
+	})
+}
+
+// List return the deliveries sorted by ID
+func (q *Queue) List() ([]*Delivery, error) {
+	deliveries := make([]*Delivery, 0)
+	err := q.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(deliveriesBucket).ForEach(func(k, v []byte) error {
+			var delivery Delivery
+			if err := json.Unmarshal(v, &delivery); err != nil {
+				return err
+			}
+			deliveries = append(deliveries, &delivery)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return deliveries, nil
+}
+
+func (q *Queue) Update(delivery *Delivery) error {
+	return q.db.Update(func(tx *bbolt.Tx) error {
+		return put(tx.Bucket(deliveriesBucket), delivery)
+	})
+}
+
+func (q *Queue) Delete(id uint64) error {
+	return q.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(deliveriesBucket).Delete(key(id))
+	})
+}
+
+func (q *Queue) Close() error {
+	return q.db.Close()
+}
+
+func put(bucket *bbolt.Bucket, delivery *Delivery) error {
+	value, err := json.Marshal(delivery)
+	if err != nil {
+		return err
+	}
+	return bucket.Put(key(delivery.ID), value)
+}
+
+// key is big endian so the deliveries are iterated in the push order
+func key(id uint64) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, id)
+	return k
+}
@@ -0,0 +1,88 @@
+package passthrough
+
+import (
+	"akwatek-mqtt-bridge/models"
+	"akwatek-mqtt-bridge/utils"
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"io"
+	"net/http"
+)
+
+const (
+	VALVE_PRIORITY_MQTT  string = "mqtt"
+	VALVE_PRIORITY_CLOUD string = "cloud"
+)
+
+// Client relay the controller's calls to the Akwatek cloud
+type Client struct {
+	config *utils.ConfigPassthrough
+	http   *http.Client
+}
+
+func NewPassthrough(config *utils.Config) *Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{
+		InsecureSkipVerify: config.Passthrough.InsecureSkipVerify,
+	}
+	return &Client{
+		config: config.Passthrough,
+		http: &http.Client{
+			Timeout:   config.Passthrough.Timeout,
+			Transport: transport,
+		},
+	}
+}
+
+// Relay forward the raw body of the controller's request to the upstream and decode its response
+func (c *Client) Relay(body []byte, header http.Header) (*models.ResBodyItekV1, error) {
+	req, err := http.NewRequest(http.MethodPost, c.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range []string{"Content-Type", "User-Agent", "Accept"} {
+		if value := header.Get(key); value != "" {
+			req.Header.Set(key, value)
+		}
+	}
+
+	res, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	resBody, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("upstream returned %s", res.Status)
+	}
+	log.Debug().Msgf("upstream response: %s", resBody)
+
+	var resBodyItekV1 models.ResBodyItekV1
+	if err := json.Unmarshal(resBody, &resBodyItekV1); err != nil {
+		return nil, err
+	}
+	return &resBodyItekV1, nil
+}
+
+// MergeValve decide which valve action is sent to the controller when MQTT and the cloud disagree
+func (c *Client) MergeValve(local *models.ValveAction, cloud *models.ValveAction) *models.ValveAction {
+	if local == nil {
+		return cloud
+	}
+	if cloud == nil || *local == *cloud {
+		return local
+	}
+	if c.config.ValvePriority == VALVE_PRIORITY_CLOUD {
+		log.Warn().Msgf("valve action from mqtt (%s) overridden by cloud (%s)", *local, *cloud)
+		return cloud
+	}
+	log.Warn().Msgf("valve action from cloud (%s) overridden by mqtt (%s)", *cloud, *local)
+	return local
+}
@@ -0,0 +1,120 @@
+package passthrough
+
+import (
+	"akwatek-mqtt-bridge/models"
+	"akwatek-mqtt-bridge/utils"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+const checkIn = `{"Itek_V1":{"MAC_address":"bc:ff:4d:00:00:01","ID":"1.0","Cont_status":"18041","zone01-25":"111"}}`
+
+func newClient(url string, valvePriority string) *Client {
+	return NewPassthrough(&utils.Config{
+		Passthrough: &utils.ConfigPassthrough{
+			Enabled:            true,
+			URL:                url,
+			ValvePriority:      valvePriority,
+			Timeout:            time.Second,
+			InsecureSkipVerify: true,
+		},
+	})
+}
+
+func TestRelay(t *testing.T) {
+	var body []byte
+	var header http.Header
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ = io.ReadAll(r.Body)
+		header = r.Header
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"Itek_V1":{"mess":"OK cloud","valve":"0"}}`))
+	}))
+	defer server.Close()
+
+	res, err := newClient(server.URL, VALVE_PRIORITY_MQTT).Relay([]byte(checkIn), http.Header{
+		"Content-Type": {"application/json"},
+		"User-Agent":   {"Leako"},
+		"Cookie":       {"secret"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != checkIn {
+		t.Errorf("relayed body %q, expected %q", body, checkIn)
+	}
+	if header.Get("User-Agent") != "Leako" || header.Get("Content-Type") != "application/json" {
+		t.Errorf("headers not relayed: %v", header)
+	}
+	if header.Get("Cookie") != "" {
+		t.Errorf("unexpected header relayed: %v", header)
+	}
+	if res.ItekV1.Message != "OK cloud" || res.ItekV1.Valve == nil || *res.ItekV1.Valve != models.VALVE_ACTION_CLOSE {
+		t.Errorf("unexpected response %+v", res.ItekV1)
+	}
+}
+
+func TestRelayFallback(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+	}{
+		{"non-200", func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "maintenance", http.StatusServiceUnavailable)
+		}},
+		{"invalid body", func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte("<html>"))
+		}},
+		{"timeout", func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(2 * time.Second)
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := httptest.NewTLSServer(test.handler)
+			defer server.Close()
+			if res, err := newClient(server.URL, VALVE_PRIORITY_MQTT).Relay([]byte(checkIn), http.Header{}); err == nil {
+				t.Errorf("expected an error, got %+v", res)
+			}
+		})
+	}
+
+	t.Run("upstream down", func(t *testing.T) {
+		server := httptest.NewTLSServer(http.NotFoundHandler())
+		url := server.URL
+		server.Close()
+		if res, err := newClient(url, VALVE_PRIORITY_MQTT).Relay([]byte(checkIn), http.Header{}); err == nil {
+			t.Errorf("expected an error, got %+v", res)
+		}
+	})
+}
+
+func TestMergeValve(t *testing.T) {
+	open := models.VALVE_ACTION_OPEN
+	closed := models.VALVE_ACTION_CLOSE
+	tests := []struct {
+		name     string
+		priority string
+		local    *models.ValveAction
+		cloud    *models.ValveAction
+		expected *models.ValveAction
+	}{
+		{"nothing", VALVE_PRIORITY_MQTT, nil, nil, nil},
+		{"cloud only", VALVE_PRIORITY_MQTT, nil, &closed, &closed},
+		{"mqtt only", VALVE_PRIORITY_CLOUD, &open, nil, &open},
+		{"same action", VALVE_PRIORITY_CLOUD, &closed, &closed, &closed},
+		{"mqtt priority", VALVE_PRIORITY_MQTT, &open, &closed, &open},
+		{"cloud priority", VALVE_PRIORITY_CLOUD, &open, &closed, &closed},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			merged := newClient("https://localhost", test.priority).MergeValve(test.local, test.cloud)
+			if (merged == nil) != (test.expected == nil) || (merged != nil && *merged != *test.expected) {
+				t.Errorf("got %v, expected %v", merged, test.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,199 @@
+package policy
+
+import (
+	"akwatek-mqtt-bridge/models"
+	"akwatek-mqtt-bridge/utils"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	POLICY_LEAK        string = "leak"
+	POLICY_LOST_SIGNAL string = "lost_signal"
+	POLICY_POWER_LOSS  string = "power_loss"
+)
+
+// Rule decide if the valve of a controller must be closed, it return the reason when it's the case
+type Rule interface {
+	Name() string
+	Type() string
+	Evaluate(ctl *models.AkwatekCtl, now time.Time) (bool, string)
+}
+
+// Firing is a rule that just started to match a controller
+type Firing struct {
+	Rule   Rule
+	Reason string
+}
+
+// Engine evaluate the rules on every check-in,
+// a rule fires once when its condition become true and again only after it was false
+type Engine struct {
+	rules  []Rule
+	mu     sync.Mutex
+	active map[string]map[string]bool
+}
+
+func NewEngine(policies []*utils.ConfigPolicy) (*Engine, error) {
+	engine := &Engine{
+		active: map[string]map[string]bool{},
+	}
+	names := map[string]bool{}
+	for i, policy := range policies {
+		rule, err := NewRule(policy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid policy #%d: %w", i+1, err)
+		}
+		if names[rule.Name()] {
+			return nil, fmt.Errorf("invalid policy #%d: duplicated name %q", i+1, rule.Name())
+		}
+		names[rule.Name()] = true
+		engine.rules = append(engine.rules, rule)
+	}
+	return engine, nil
+}
+
+// NewRule return the rule of a policy config
+func NewRule(policy *utils.ConfigPolicy) (Rule, error) {
+	name := policy.Name
+	if name == "" {
+		name = policy.Type
+	}
+	switch policy.Type {
+	case POLICY_LEAK:
+		return &LeakRule{name: name, Zones: policy.Zones}, nil
+	case POLICY_LOST_SIGNAL:
+		minSensors := policy.MinSensors
+		if minSensors < 1 {
+			minSensors = 1
+		}
+		return &LostSignalRule{
+			name:       name,
+			MinSensors: minSensors,
+			Duration:   policy.Duration,
+			lostSince:  map[string]map[int]time.Time{},
+		}, nil
+	case POLICY_POWER_LOSS:
+		return &PowerLossRule{name: name}, nil
+	}
+	return nil, fmt.Errorf("unknown type %q, expected %s, %s or %s", policy.Type, POLICY_LEAK, POLICY_LOST_SIGNAL, POLICY_POWER_LOSS)
+}
+
+// Rules return the rules of the engine, in the config order
+func (e *Engine) Rules() []Rule {
+	return e.rules
+}
+
+// Evaluate return the rules that started to match the controller since the last evaluation
+func (e *Engine) Evaluate(ctl *models.AkwatekCtl, now time.Time) []*Firing {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	active, ok := e.active[ctl.GetIdentifier()]
+	if !ok {
+		active = map[string]bool{}
+		e.active[ctl.GetIdentifier()] = active
+	}
+
+	firings := make([]*Firing, 0)
+	for _, rule := range e.rules {
+		matched, reason := rule.Evaluate(ctl, now)
+		if matched && !active[rule.Name()] {
+			firings = append(firings, &Firing{Rule: rule, Reason: reason})
+		}
+		active[rule.Name()] = matched
+	}
+	return firings
+}
+
+// LeakRule match when a sensor detect water, only the listed zones if any
+type LeakRule struct {
+	name  string
+	Zones []int
+}
+
+func (r *LeakRule) Name() string {
+	return r.name
+}
+
+func (r *LeakRule) Type() string {
+	return POLICY_LEAK
+}
+
+func (r *LeakRule) Evaluate(ctl *models.AkwatekCtl, now time.Time) (bool, string) {
+	for _, sensor := range ctl.GetSensors() {
+		if !sensor.IsConfigured() || sensor.IsRemoved() || sensor.IsIgnored() || !sensor.IsWaterDetected() {
+			continue
+		}
+		if len(r.Zones) > 0 && !slices.Contains(r.Zones, sensor.ID) {
+			continue
+		}
+		return true, fmt.Sprintf("water detected by the sensor of zone %d", sensor.ID)
+	}
+	return false, ""
+}
+
+// LostSignalRule match when at least MinSensors sensors lost the signal for Duration
+type LostSignalRule struct {
+	name       string
+	MinSensors int
+	Duration   time.Duration
+	mu         sync.Mutex
+	lostSince  map[string]map[int]time.Time
+}
+
+func (r *LostSignalRule) Name() string {
+	return r.name
+}
+
+func (r *LostSignalRule) Type() string {
+	return POLICY_LOST_SIGNAL
+}
+
+func (r *LostSignalRule) Evaluate(ctl *models.AkwatekCtl, now time.Time) (bool, string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	previous := r.lostSince[ctl.GetIdentifier()]
+	lostSince := map[int]time.Time{}
+	lost := make([]int, 0)
+	for _, sensor := range ctl.GetSensors() {
+		if !sensor.IsConfigured() || sensor.IsRemoved() || sensor.IsIgnored() || !sensor.IsLostSignal() {
+			continue
+		}
+		since, ok := previous[sensor.ID]
+		if !ok {
+			since = now
+		}
+		lostSince[sensor.ID] = since
+		if now.Sub(since) >= r.Duration {
+			lost = append(lost, sensor.ID)
+		}
+	}
+	r.lostSince[ctl.GetIdentifier()] = lostSince
+
+	if len(lost) < r.MinSensors {
+		return false, ""
+	}
+	return true, fmt.Sprintf("%d sensors lost the signal for %s, zones %v", len(lost), r.Duration, lost)
+}
+
+// PowerLossRule match when the controller run on battery
+type PowerLossRule struct {
+	name string
+}
+
+func (r *PowerLossRule) Name() string {
+	return r.name
+}
+
+func (r *PowerLossRule) Type() string {
+	return POLICY_POWER_LOSS
+}
+
+func (r *PowerLossRule) Evaluate(ctl *models.AkwatekCtl, now time.Time) (bool, string) {
+	if ctl.HasPowerLine() {
+		return false, ""
+	}
+	return true, "the controller lost the power line"
+}
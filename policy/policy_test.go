@@ -0,0 +1,137 @@
+package policy
+
+import (
+	"akwatek-mqtt-bridge/models"
+	"akwatek-mqtt-bridge/utils"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// newCtl decode the snapshot of a controller, status is Cont_status and zones is zone01-25
+func newCtl(t *testing.T, status string, zones string) *models.AkwatekCtl {
+	t.Helper()
+	var snapshot models.AkwatekCtlSnapshot
+	data := fmt.Sprintf(`{"request":{"MAC_address":"bc:ff:4d:00:00:01","ID":"1.0","Cont_status":%q,"zone01-25":%q}}`, status, zones)
+	if err := json.Unmarshal([]byte(data), &snapshot); err != nil {
+		t.Fatal(err)
+	}
+	ctl, err := models.NewAkwatekCtlFromSnapshot(&snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ctl
+}
+
+func TestLeakRule(t *testing.T) {
+	tests := []struct {
+		name    string
+		zones   []int
+		sensors string
+		matched bool
+		reason  string
+	}{
+		{"no leak", nil, "111", false, ""},
+		{"leak on any zone", nil, "191", true, "water detected by the sensor of zone 2"},
+		{"leak on a listed zone", []int{2, 3}, "191", true, "water detected by the sensor of zone 2"},
+		{"leak on another zone", []int{1, 3}, "191", false, ""},
+		{"leak of a not configured sensor", nil, "181", false, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rule := &LeakRule{name: "leak", Zones: test.zones}
+			matched, reason := rule.Evaluate(newCtl(t, "18041", test.sensors), time.Now())
+			if matched != test.matched || reason != test.reason {
+				t.Errorf("got (%t, %q), expected (%t, %q)", matched, reason, test.matched, test.reason)
+			}
+		})
+	}
+}
+
+func TestLostSignalRule(t *testing.T) {
+	start := time.Now()
+	tests := []struct {
+		name        string
+		minSensors  int
+		duration    time.Duration
+		evaluations []string
+		after       time.Duration
+		matched     []bool
+	}{
+		{"one sensor lost", 1, 0, []string{"131"}, 0, []bool{true}},
+		{"less sensors than the minimum", 2, 0, []string{"131", "131"}, time.Minute, []bool{false, false}},
+		{"enough sensors", 2, 0, []string{"133"}, 0, []bool{true}},
+		{"lost for the duration", 1, 5 * time.Minute, []string{"131", "131", "131"}, 3 * time.Minute, []bool{false, false, true}},
+		{"found again before the duration", 1, 5 * time.Minute, []string{"131", "111", "131"}, 3 * time.Minute, []bool{false, false, false}},
+		{"duration of every sensor", 2, 5 * time.Minute, []string{"131", "133", "133"}, 3 * time.Minute, []bool{false, false, false}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rule, err := NewRule(&utils.ConfigPolicy{Type: POLICY_LOST_SIGNAL, MinSensors: test.minSensors, Duration: test.duration})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, sensors := range test.evaluations {
+				now := start.Add(time.Duration(i) * test.after)
+				if matched, reason := rule.Evaluate(newCtl(t, "18041", sensors), now); matched != test.matched[i] {
+					t.Errorf("evaluation %d: got (%t, %q), expected %t", i+1, matched, reason, test.matched[i])
+				}
+			}
+		})
+	}
+}
+
+func TestPowerLossRule(t *testing.T) {
+	tests := []struct {
+		status  string
+		matched bool
+	}{
+		{"18041", false},
+		{"08041", true},
+	}
+	for _, test := range tests {
+		t.Run(test.status, func(t *testing.T) {
+			rule := &PowerLossRule{name: "power"}
+			if matched, _ := rule.Evaluate(newCtl(t, test.status, "1"), time.Now()); matched != test.matched {
+				t.Errorf("got %t, expected %t", matched, test.matched)
+			}
+		})
+	}
+}
+
+func TestEngineFireOnce(t *testing.T) {
+	engine, err := NewEngine([]*utils.ConfigPolicy{{Type: POLICY_LEAK}, {Type: POLICY_POWER_LOSS}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		status  string
+		sensors string
+		fired   []string
+	}{
+		{"18041", "111", []string{}},
+		{"18041", "191", []string{POLICY_LEAK}},
+		{"18041", "191", []string{}},
+		{"08041", "191", []string{POLICY_POWER_LOSS}},
+		{"18041", "111", []string{}},
+		{"18041", "191", []string{POLICY_LEAK}},
+	}
+	now := time.Now()
+	for i, test := range tests {
+		firings := engine.Evaluate(newCtl(t, test.status, test.sensors), now)
+		fired := make([]string, 0, len(firings))
+		for _, firing := range firings {
+			fired = append(fired, firing.Rule.Name())
+		}
+		if fmt.Sprint(fired) != fmt.Sprint(test.fired) {
+			t.Errorf("evaluation %d: fired %v, expected %v", i+1, fired, test.fired)
+		}
+	}
+}
+
+func TestNewEngineDuplicatedName(t *testing.T) {
+	if _, err := NewEngine([]*utils.ConfigPolicy{{Type: POLICY_LEAK}, {Type: POLICY_LEAK}}); err == nil {
+		t.Error("expected an error for duplicated names")
+	}
+}
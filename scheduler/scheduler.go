@@ -0,0 +1,233 @@
+package scheduler
+
+import (
+	"akwatek-mqtt-bridge/models"
+	"akwatek-mqtt-bridge/utils"
+	"fmt"
+	"github.com/robfig/cron/v3"
+	"github.com/rs/zerolog/log"
+	"net"
+	"regexp"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	SCHEDULE_EXERCISE string = "exercise"
+	SCHEDULE_VACATION string = "vacation"
+)
+
+var scheduleNameRegexp = regexp.MustCompile(`^[a-z0-9_-]+$`)
+
+// Schedule is a scheduled valve action, an exercise cycle or a vacation window
+type Schedule struct {
+	Name                string
+	Type                string
+	ReopenAfterCheckIns int
+	Start               time.Time
+	End                 time.Time
+	cron                cron.Schedule
+	controllers         []string
+}
+
+// Applies return true if the schedule is for every controller or list this one
+func (s *Schedule) Applies(ctl *models.AkwatekCtl) bool {
+	return len(s.controllers) == 0 || slices.Contains(s.controllers, ctl.GetIdentifier())
+}
+
+// Scheduler decide on every check-in the valve commands of the schedules,
+// an exercise cycle start on the first check-in after its cron is due,
+// the states are saved with the controller so a cycle survives a restart
+type Scheduler struct {
+	schedules []*Schedule
+	mu        sync.Mutex
+}
+
+func NewScheduler(schedules []*utils.ConfigSchedule) (*Scheduler, error) {
+	scheduler := &Scheduler{}
+	names := map[string]bool{}
+	for i, config := range schedules {
+		schedule, err := NewSchedule(config)
+		if err != nil {
+			return nil, fmt.Errorf("invalid schedule #%d: %w", i+1, err)
+		}
+		if names[schedule.Name] {
+			return nil, fmt.Errorf("invalid schedule #%d: duplicated name %q", i+1, schedule.Name)
+		}
+		names[schedule.Name] = true
+		scheduler.schedules = append(scheduler.schedules, schedule)
+	}
+	return scheduler, nil
+}
+
+func NewSchedule(config *utils.ConfigSchedule) (*Schedule, error) {
+	schedule := &Schedule{
+		Name:                config.Name,
+		Type:                config.Type,
+		ReopenAfterCheckIns: config.ReopenAfterCheckIns,
+		Start:               config.Start,
+		End:                 config.End,
+		controllers:         make([]string, 0, len(config.Controllers)),
+	}
+	if schedule.Name == "" {
+		schedule.Name = schedule.Type
+	}
+	if !scheduleNameRegexp.MatchString(schedule.Name) {
+		return nil, fmt.Errorf("invalid name %q, expected lower case letters, digits, _ or -", schedule.Name)
+	}
+	for _, controller := range config.Controllers {
+		mac, err := net.ParseMAC(controller)
+		if err != nil {
+			return nil, err
+		}
+		schedule.controllers = append(schedule.controllers, models.GetIdentifierFromMAC(mac))
+	}
+
+	switch schedule.Type {
+	case SCHEDULE_EXERCISE:
+		var err error
+		if schedule.cron, err = cron.ParseStandard(config.Cron); err != nil {
+			return nil, fmt.Errorf("invalid cron %q: %w", config.Cron, err)
+		}
+		if schedule.ReopenAfterCheckIns < 1 {
+			schedule.ReopenAfterCheckIns = 1
+		}
+	case SCHEDULE_VACATION:
+		if schedule.Start.IsZero() || !schedule.End.After(schedule.Start) {
+			return nil, fmt.Errorf("invalid vacation window, expected a start before the end")
+		}
+	default:
+		return nil, fmt.Errorf("unknown type %q, expected %s or %s", schedule.Type, SCHEDULE_EXERCISE, SCHEDULE_VACATION)
+	}
+	return schedule, nil
+}
+
+// Schedules return the schedules of a controller
+func (s *Scheduler) Schedules(ctl *models.AkwatekCtl) []*Schedule {
+	schedules := make([]*Schedule, 0)
+	for _, schedule := range s.schedules {
+		if schedule.Applies(ctl) {
+			schedules = append(schedules, schedule)
+		}
+	}
+	return schedules
+}
+
+// Evaluate return the valve commands to queue for the controller on this check-in
+func (s *Scheduler) Evaluate(ctl *models.AkwatekCtl, now time.Time) []*models.ValveCommand {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	commands := make([]*models.ValveCommand, 0)
+	for _, schedule := range s.Schedules(ctl) {
+		st, ok := ctl.GetScheduleState(schedule.Name)
+		if !ok {
+			ctl.SetScheduleState(schedule.Name, schedule.newState(now))
+			continue
+		}
+		// a disabled schedule doesn't start a new cycle, but finish the running one so the valve isn't left closed
+		enabled := ctl.IsScheduleEnabled(schedule.Name)
+		var command *models.ValveCommand
+		switch schedule.Type {
+		case SCHEDULE_EXERCISE:
+			command = schedule.evaluateExercise(ctl, &st, now, enabled)
+		case SCHEDULE_VACATION:
+			command = schedule.evaluateVacation(ctl, &st, now, enabled)
+		}
+		ctl.SetScheduleState(schedule.Name, st)
+		if command != nil {
+			commands = append(commands, command)
+		}
+	}
+	return commands
+}
+
+func (s *Schedule) newState(now time.Time) models.ScheduleState {
+	st := models.ScheduleState{}
+	if s.cron != nil {
+		st.Next = s.cron.Next(now)
+	}
+	return st
+}
+
+func (s *Schedule) newCommand(action models.ValveAction, reason string) *models.ValveCommand {
+	return models.NewValveCommand(action, "schedule:"+s.Name, reason)
+}
+
+// evaluateExercise close the valve when the cron is due, and open it again after ReopenAfterCheckIns confirmed check-ins,
+// once disabled no cycle is started and the next one is due from the time it's enabled again
+func (s *Schedule) evaluateExercise(ctl *models.AkwatekCtl, st *models.ScheduleState, now time.Time, enabled bool) *models.ValveCommand {
+	if st.Command == "" {
+		if !enabled {
+			st.Next = s.cron.Next(now)
+			return nil
+		}
+		if now.Before(st.Next) {
+			return nil
+		}
+		st.Next = s.cron.Next(now)
+		// a valve closed by someone else stays closed
+		if !ctl.IsSimulatedValveOpen() || ctl.HasAlarm() {
+			log.Info().Msgf("schedule %s skipped for %s, the valve is closed", s.Name, ctl.MAC)
+			return nil
+		}
+		command := s.newCommand(models.VALVE_ACTION_CLOSE, "exercise cycle")
+		st.Command = command.ID
+		st.CheckIns = 0
+		return command
+	}
+
+	// the due times during the cycle are skipped
+	st.Next = s.cron.Next(now)
+	current := ctl.GetValveCommand()
+	if current == nil || current.ID != st.Command || current.Status == models.VALVE_COMMAND_FAILED {
+		log.Warn().Msgf("schedule %s of %s interrupted, the valve isn't opened again", s.Name, ctl.MAC)
+		st.Command = ""
+		return nil
+	}
+	if current.Status != models.VALVE_COMMAND_CONFIRMED {
+		return nil
+	}
+	st.CheckIns++
+	if st.CheckIns < s.ReopenAfterCheckIns {
+		return nil
+	}
+	st.Command = ""
+	if ctl.HasAlarm() {
+		log.Warn().Msgf("schedule %s of %s doesn't open the valve again, the alarm is on", s.Name, ctl.MAC)
+		return nil
+	}
+	return s.newCommand(models.VALVE_ACTION_OPEN, "exercise cycle is over")
+}
+
+// evaluateVacation keep the valve closed during the window and open it again at the end,
+// or as soon as it's disabled
+func (s *Schedule) evaluateVacation(ctl *models.AkwatekCtl, st *models.ScheduleState, now time.Time, enabled bool) *models.ValveCommand {
+	inWindow := enabled && !now.Before(s.Start) && now.Before(s.End)
+	if !inWindow {
+		if !st.Active {
+			return nil
+		}
+		st.Active = false
+		if ctl.IsSimulatedValveOpen() {
+			return nil
+		}
+		if ctl.HasAlarm() {
+			log.Warn().Msgf("schedule %s of %s doesn't open the valve again, the alarm is on", s.Name, ctl.MAC)
+			return nil
+		}
+		return s.newCommand(models.VALVE_ACTION_OPEN, "vacation is over")
+	}
+
+	st.Active = true
+	if !ctl.IsSimulatedValveOpen() {
+		return nil
+	}
+	// wait for the running command, and don't retry a closing that failed
+	current := ctl.GetValveCommand()
+	if current != nil && (!current.IsDone() ||
+		(current.Status == models.VALVE_COMMAND_FAILED && current.Source == "schedule:"+s.Name)) {
+		return nil
+	}
+	return s.newCommand(models.VALVE_ACTION_CLOSE, "vacation")
+}
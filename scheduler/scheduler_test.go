@@ -0,0 +1,146 @@
+package scheduler
+
+import (
+	"akwatek-mqtt-bridge/models"
+	"akwatek-mqtt-bridge/utils"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// newCtl decode the snapshot of a controller with its valve open
+func newCtl(t *testing.T) *models.AkwatekCtl {
+	t.Helper()
+	var snapshot models.AkwatekCtlSnapshot
+	data := `{"request":{"MAC_address":"bc:ff:4d:00:00:01","ID":"1.0","Cont_status":"18041","zone01-25":"111"}}`
+	if err := json.Unmarshal([]byte(data), &snapshot); err != nil {
+		t.Fatal(err)
+	}
+	ctl, err := models.NewAkwatekCtlFromSnapshot(&snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ctl
+}
+
+// checkIn parse a check-in of the controller with the valve bit and confirm the sent command
+func checkIn(t *testing.T, ctl *models.AkwatekCtl, valveOpen bool) {
+	t.Helper()
+	request := ctl.GetLastRequest()
+	request.CtlStatus = "18040"
+	if valveOpen {
+		request.CtlStatus = "18041"
+	}
+	if err := ctl.Parse(&request); err != nil {
+		t.Fatal(err)
+	}
+	ctl.CheckValveCommand(1, 3)
+}
+
+// evaluate queue and send the command of the schedule if any, and return its action
+func evaluate(t *testing.T, s *Scheduler, ctl *models.AkwatekCtl, now time.Time) string {
+	t.Helper()
+	commands := s.Evaluate(ctl, now)
+	if len(commands) == 0 {
+		return ""
+	}
+	if len(commands) > 1 {
+		t.Fatalf("got %d commands, expected one", len(commands))
+	}
+	ctl.QueueValveCommand(commands[0])
+	ctl.TakeValveCommand()
+	return commands[0].Action.String()
+}
+
+func TestExerciseDisabledDuringCycle(t *testing.T) {
+	s, err := NewScheduler([]*utils.ConfigSchedule{{Type: SCHEDULE_EXERCISE, Cron: "0 3 * * 0", ReopenAfterCheckIns: 2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctl := newCtl(t)
+	now := time.Date(2026, 10, 17, 12, 0, 0, 0, time.Local)
+	if action := evaluate(t, s, ctl, now); action != "" {
+		t.Fatalf("first evaluation sent %s", action)
+	}
+	due := time.Date(2026, 10, 18, 3, 0, 0, 0, time.Local)
+	if action := evaluate(t, s, ctl, due); action != "CLOSE" {
+		t.Fatalf("got %q when the cron is due, expected CLOSE", action)
+	}
+	checkIn(t, ctl, false)
+	ctl.SetScheduleEnabled(SCHEDULE_EXERCISE, false)
+
+	actions := make([]string, 0)
+	for i := 1; i <= 3; i++ {
+		actions = append(actions, evaluate(t, s, ctl, due.Add(time.Duration(i)*time.Minute)))
+	}
+	if fmt.Sprint(actions) != fmt.Sprint([]string{"", "OPEN", ""}) {
+		t.Errorf("got %q after the schedule is disabled, expected the valve opened again", actions)
+	}
+
+	// no new cycle while disabled
+	checkIn(t, ctl, true)
+	if action := evaluate(t, s, ctl, due.Add(7*24*time.Hour)); action != "" {
+		t.Errorf("disabled schedule sent %s", action)
+	}
+}
+
+func TestVacationDisabledDuringWindow(t *testing.T) {
+	now := time.Date(2026, 10, 17, 12, 0, 0, 0, time.Local)
+	s, err := NewScheduler([]*utils.ConfigSchedule{{Type: SCHEDULE_VACATION, Start: now.Add(time.Hour), End: now.Add(48 * time.Hour)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctl := newCtl(t)
+	tests := []struct {
+		after     time.Duration
+		valveOpen bool
+		enabled   bool
+		action    string
+	}{
+		{0, true, true, ""},
+		{2 * time.Hour, true, true, "CLOSE"},
+		{3 * time.Hour, false, true, ""},
+		{4 * time.Hour, false, false, "OPEN"},
+		{5 * time.Hour, true, false, ""},
+	}
+	for i, test := range tests {
+		checkIn(t, ctl, test.valveOpen)
+		ctl.SetScheduleEnabled(SCHEDULE_VACATION, test.enabled)
+		if action := evaluate(t, s, ctl, now.Add(test.after)); action != test.action {
+			t.Errorf("evaluation %d: got %q, expected %q", i+1, action, test.action)
+		}
+	}
+}
+
+// TestVacationDryRun check the schedule follow the simulated valve in dry-run,
+// the controller keep reporting the valve open and the closing isn't sent again on every check-in
+func TestVacationDryRun(t *testing.T) {
+	now := time.Date(2026, 10, 17, 12, 0, 0, 0, time.Local)
+	s, err := NewScheduler([]*utils.ConfigSchedule{{Type: SCHEDULE_VACATION, Start: now.Add(time.Hour), End: now.Add(48 * time.Hour)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctl := newCtl(t)
+	ctl.SetDryRun(true)
+	tests := []struct {
+		after  time.Duration
+		action string
+	}{
+		{0, ""},
+		{2 * time.Hour, "CLOSE"},
+		{3 * time.Hour, ""},
+		{4 * time.Hour, ""},
+		{49 * time.Hour, "OPEN"},
+		{50 * time.Hour, ""},
+	}
+	for i, test := range tests {
+		checkIn(t, ctl, true)
+		if action := evaluate(t, s, ctl, now.Add(test.after)); action != test.action {
+			t.Errorf("evaluation %d: got %q, expected %q", i+1, action, test.action)
+		}
+	}
+	if !ctl.IsValveOpen() {
+		t.Errorf("the valve bit moved in dry-run")
+	}
+}
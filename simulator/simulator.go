@@ -0,0 +1,256 @@
+package simulator
+
+import (
+	"akwatek-mqtt-bridge/models"
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	EVENT_LEAK      string = "leak"
+	EVENT_DRY       string = "dry"
+	EVENT_LOW_BAT   string = "lowbat"
+	EVENT_BAT_OK    string = "bat"
+	EVENT_LOST      string = "lost"
+	EVENT_SIGNAL    string = "signal"
+	EVENT_POWER_OFF string = "power-off"
+	EVENT_POWER_ON  string = "power-on"
+	EVENT_RESET     string = "reset"
+	ZONES_COUNT     int    = 100
+)
+
+// Event is a scripted change of a simulated controller, applied After the start of the simulation
+type Event struct {
+	After time.Duration
+	Kind  string
+	Zone  int
+}
+
+// ParseEvent parse an event like "2m:leak:7" or "10m:power-off"
+func ParseEvent(value string) (*Event, error) {
+	parts := strings.Split(value, ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return nil, fmt.Errorf("invalid event %q, expected <after>:<kind>[:<zone>]", value)
+	}
+	after, err := time.ParseDuration(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid event %q: %w", value, err)
+	}
+	event := &Event{After: after, Kind: parts[1]}
+	switch event.Kind {
+	case EVENT_LEAK, EVENT_DRY, EVENT_LOW_BAT, EVENT_BAT_OK, EVENT_LOST, EVENT_SIGNAL:
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("invalid event %q, %s need a zone", value, event.Kind)
+		}
+		event.Zone, err = strconv.Atoi(parts[2])
+		if err != nil || event.Zone < 1 || event.Zone > ZONES_COUNT {
+			return nil, fmt.Errorf("invalid event %q, zone must be between 1 and %d", value, ZONES_COUNT)
+		}
+	case EVENT_POWER_OFF, EVENT_POWER_ON, EVENT_RESET:
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid event %q, %s doesn't take a zone", value, event.Kind)
+		}
+	default:
+		return nil, fmt.Errorf("invalid event %q, unknown kind %s", value, event.Kind)
+	}
+	return event, nil
+}
+
+func (e *Event) String() string {
+	if e.Zone > 0 {
+		return fmt.Sprintf("%s:%s:%d", e.After, e.Kind, e.Zone)
+	}
+	return fmt.Sprintf("%s:%s", e.After, e.Kind)
+}
+
+// Controller act like an Akwatek controller calling the bridge
+type Controller struct {
+	MAC    net.HardwareAddr
+	ID     string
+	mu     sync.Mutex
+	status []byte
+	zones  []byte
+	events []*Event
+	valve  *models.ValveAction
+}
+
+func NewController(mac net.HardwareAddr, status string, zones string, events []*Event) (*Controller, error) {
+	c := &Controller{
+		MAC:    mac,
+		ID:     "1213",
+		events: events,
+	}
+	var err error
+	if c.status, err = parseNibbles(status); err != nil {
+		return nil, err
+	}
+	if len(c.status) != 5 {
+		return nil, fmt.Errorf("invalid controller status %q, expected 5 hex digits", status)
+	}
+	if len(zones) > ZONES_COUNT {
+		return nil, fmt.Errorf("invalid zones %q, expected at most %d hex digits", zones, ZONES_COUNT)
+	}
+	if c.zones, err = parseNibbles(zones + strings.Repeat("0", ZONES_COUNT-len(zones))); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func parseNibbles(value string) ([]byte, error) {
+	nibbles := make([]byte, 0, len(value))
+	for _, digit := range value {
+		nibble, err := strconv.ParseUint(string(digit), 16, 4)
+		if err != nil {
+			return nil, err
+		}
+		nibbles = append(nibbles, byte(nibble))
+	}
+	return nibbles, nil
+}
+
+func formatNibbles(nibbles []byte) string {
+	value := strings.Builder{}
+	for _, nibble := range nibbles {
+		value.WriteString(strings.ToUpper(strconv.FormatUint(uint64(nibble), 16)))
+	}
+	return value.String()
+}
+
+func setBit(nibble *byte, bit byte, on bool) {
+	if on {
+		*nibble |= bit
+	} else {
+		*nibble &^= bit
+	}
+}
+
+// apply the scripted events due since the start, and the valve action received on the last check-in
+func (c *Controller) apply(elapsed time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.valve != nil {
+		// the controller can't open the valve remotely while in alarm
+		if *c.valve == models.VALVE_ACTION_CLOSE || c.status[2]&0b1 == 0 {
+			setBit(&c.status[4], 0b1, *c.valve == models.VALVE_ACTION_OPEN)
+		}
+		c.valve = nil
+	}
+
+	remaining := c.events[:0]
+	for _, event := range c.events {
+		if event.After > elapsed {
+			remaining = append(remaining, event)
+			continue
+		}
+		log.Info().Msgf("[%s] event %s", c.MAC, event)
+		switch event.Kind {
+		case EVENT_LEAK:
+			setBit(&c.zones[event.Zone-1], 0b1001, true)
+			// the controller close the valve and raise the alarm on leak
+			setBit(&c.status[2], 0b1, true)
+			setBit(&c.status[4], 0b1, false)
+		case EVENT_DRY:
+			setBit(&c.zones[event.Zone-1], 0b1000, false)
+		case EVENT_LOW_BAT:
+			setBit(&c.zones[event.Zone-1], 0b0101, true)
+		case EVENT_BAT_OK:
+			setBit(&c.zones[event.Zone-1], 0b0100, false)
+		case EVENT_LOST:
+			setBit(&c.zones[event.Zone-1], 0b0011, true)
+		case EVENT_SIGNAL:
+			setBit(&c.zones[event.Zone-1], 0b0010, false)
+		case EVENT_POWER_OFF:
+			setBit(&c.status[0], 0b1, false)
+		case EVENT_POWER_ON:
+			setBit(&c.status[0], 0b1, true)
+		case EVENT_RESET:
+			setBit(&c.status[2], 0b1, false)
+		}
+	}
+	c.events = remaining
+}
+
+func (c *Controller) request() *models.ReqBodyItekV1 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return &models.ReqBodyItekV1{
+		ItekV1: models.ReqItekV1{
+			MacAddress:  c.MAC,
+			ID:          c.ID,
+			CtlStatus:   formatNibbles(c.status),
+			Zone01To25:  formatNibbles(c.zones[0:25]),
+			Zone26To50:  formatNibbles(c.zones[25:50]),
+			Zone51To75:  formatNibbles(c.zones[50:75]),
+			Zone76To100: formatNibbles(c.zones[75:100]),
+		},
+	}
+}
+
+// CheckIn post the controller status and keep the valve action of the response for the next cycle
+func (c *Controller) CheckIn(client *http.Client, url string) error {
+	body, err := json.Marshal(c.request())
+	if err != nil {
+		return err
+	}
+	log.Debug().Msgf("[%s] %s", c.MAC, body)
+	res, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	resBody, err := io.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("bridge returned %s: %s", res.Status, resBody)
+	}
+
+	var resBodyItekV1 models.ResBodyItekV1
+	if err := json.Unmarshal(resBody, &resBodyItekV1); err != nil {
+		return err
+	}
+	log.Info().Msgf("[%s] status=%s response=%s", c.MAC, c.request().ItekV1.CtlStatus, resBody)
+	if resBodyItekV1.ItekV1.Valve != nil {
+		c.mu.Lock()
+		c.valve = resBodyItekV1.ItekV1.Valve
+		c.mu.Unlock()
+	}
+	return nil
+}
+
+// Run check-in on every interval until stop is closed
+func (c *Controller) Run(url string, interval time.Duration, stop <-chan struct{}) {
+	client := &http.Client{
+		Timeout: 30 * time.Second,
+		Transport: &http.Transport{
+			// like the real controller, the certificate chain isn't validated
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+	}
+	start := time.Now()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		c.apply(time.Since(start))
+		if err := c.CheckIn(client, url); err != nil {
+			log.Error().Err(err).Msgf("[%s] check-in failed", c.MAC)
+		}
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package sink
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// File append every record to a JSONL file
+type File struct {
+	name string
+	mu   sync.Mutex
+	file *os.File
+}
+
+func NewFile(name string, path string) (*File, error) {
+	if path == "" {
+		return nil, fmt.Errorf("missing path of the file sink")
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o640)
+	if err != nil {
+		return nil, err
+	}
+	return &File{name: name, file: file}, nil
+}
+
+func (f *File) Name() string {
+	return f.name
+}
+
+func (f *File) Publish(record *Record) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, err = f.file.Write(append(line, '\n'))
+	return err
+}
+
+func (f *File) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.file.Close()
+}
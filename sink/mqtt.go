@@ -0,0 +1,62 @@
+package sink
+
+import (
+	"akwatek-mqtt-bridge/models"
+	mqtt_client "akwatek-mqtt-bridge/mqtt-client"
+	"akwatek-mqtt-bridge/utils"
+	"encoding/json"
+)
+
+// MQTT publish the availability and the state of the controller and its sensors under AMB_MQTT_BASE_TOPIC,
+// the topics of the Home Assistant discovery, and receive the valve commands
+type MQTT struct {
+	name      string
+	cli       *mqtt_client.Client
+	baseTopic string
+}
+
+func NewMQTT(name string, config *utils.Config, cli *mqtt_client.Client) *MQTT {
+	return &MQTT{
+		name:      name,
+		cli:       cli,
+		baseTopic: config.MQTT.BaseTopic,
+	}
+}
+
+func (m *MQTT) Name() string {
+	return m.name
+}
+
+func (m *MQTT) Publish(record *Record) error {
+	ctl := record.Controller
+	if record.Offline {
+		m.cli.PublishAvailability(ctl.GetMQTTAvailabilityTopic(m.baseTopic), false)
+		for _, sensor := range record.Sensors {
+			m.cli.PublishAvailability(sensor.GetMQTTAvailabilityTopic(m.baseTopic), false)
+		}
+		return nil
+	}
+
+	m.cli.PublishAvailability(ctl.GetMQTTAvailabilityTopic(m.baseTopic), true)
+	m.cli.PublishState(ctl.GetMQTTStateTopic(m.baseTopic), ctl, ctl.GetMQTTUserProperties())
+	for _, sensor := range ctl.GetSensors() {
+		if sensor.IsRemoved() {
+			m.cli.PublishAvailability(sensor.GetMQTTAvailabilityTopic(m.baseTopic), false)
+		}
+	}
+	for _, sensor := range record.Sensors {
+		m.cli.PublishAvailability(sensor.GetMQTTAvailabilityTopic(m.baseTopic), true)
+		m.cli.PublishLeakState(sensor.GetMQTTStateTopic(m.baseTopic), sensor, sensor.GetMQTTUserProperties())
+	}
+	return nil
+}
+
+// WatchValve subscribe to the valve command topic of the controller
+func (m *MQTT) WatchValve(ctl *models.AkwatekCtl, callback func(payload []byte) json.Marshaler) {
+	m.cli.WatchValve(ctl.GetMQTTSValveCommandTopic(m.baseTopic), callback)
+}
+
+// Close does nothing, the MQTT client is closed on shutdown
+func (m *MQTT) Close() error {
+	return nil
+}
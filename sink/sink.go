@@ -0,0 +1,128 @@
+package sink
+
+import (
+	"akwatek-mqtt-bridge/models"
+	mqtt_client "akwatek-mqtt-bridge/mqtt-client"
+	"akwatek-mqtt-bridge/utils"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+const (
+	SINK_MQTT    string = "mqtt"
+	SINK_FILE    string = "file"
+	SINK_STDOUT  string = "stdout"
+	SINK_WEBHOOK string = "webhook"
+)
+
+// Sink receive the state of a controller on every decoded check-in, and when it goes offline
+type Sink interface {
+	Name() string
+	Publish(record *Record) error
+	Close() error
+}
+
+// CommandSource deliver the valve commands of a controller to the callback, its result is the reply to the sender
+type CommandSource interface {
+	WatchValve(ctl *models.AkwatekCtl, callback func(payload []byte) json.Marshaler)
+}
+
+// Publisher is the MQTT topics of the bridge besides the state given to the sinks: the discovery, the diagnostics,
+// the events, the valve command lifecycle and the switches of the schedules. *mqtt_client.Client implement it,
+// a fake one let the bridge run without a broker
+type Publisher interface {
+	PublishDiscovery(topic string, payload json.Marshaler)
+	PublishDiagnostics(topic string, payload json.Marshaler, userProperties map[string]string)
+	PublishEvent(topic string, payload json.Marshaler, userProperties map[string]string)
+	PublishValveResult(topic string, payload json.Marshaler, userProperties map[string]string)
+	PublishValveHistory(topic string, payload json.Marshaler)
+	PublishValveOverride(topic string, payload json.Marshaler, userProperties map[string]string)
+	PublishValveError(topic string, payload json.Marshaler, userProperties map[string]string)
+	PublishSwitchState(topicID string, on bool)
+	ClearRetained(topic string)
+	WatchCommand(topicID string, callback func(payload []byte) json.Marshaler)
+	WatchSwitch(topicID string, callback func(on bool))
+	WatchHassStatus(topicID string, callback func(online bool))
+	OnConnect(callback func())
+}
+
+// Record is the state of a controller given to the sinks, Sensors are the published ones sorted by zone
+type Record struct {
+	Time       time.Time
+	Controller *models.AkwatekCtl
+	Sensors    []*models.LeakoSensor
+	Offline    bool
+}
+
+func NewRecord(ctl *models.AkwatekCtl) *Record {
+	record := &Record{
+		Time:       time.Now(),
+		Controller: ctl,
+		Sensors:    make([]*models.LeakoSensor, 0),
+		Offline:    ctl.IsOffline(),
+	}
+	for _, sensor := range ctl.GetSensors() {
+		if sensor.IsConfigured() && !sensor.IsRemoved() && !sensor.IsIgnored() {
+			record.Sensors = append(record.Sensors, sensor)
+		}
+	}
+	return record
+}
+
+func (r *Record) MarshalJSON() ([]byte, error) {
+	sensors := make(map[string]*models.LeakoSensor, len(r.Sensors))
+	for _, sensor := range r.Sensors {
+		sensors[strconv.Itoa(sensor.ID)] = sensor
+	}
+	return json.Marshal(&struct {
+		Time       time.Time                      `json:"time"`
+		ID         string                         `json:"id"`
+		Controller *models.AkwatekCtl             `json:"controller"`
+		Sensors    map[string]*models.LeakoSensor `json:"sensors"`
+		Offline    bool                           `json:"offline"`
+	}{
+		Time:       r.Time,
+		ID:         r.Controller.GetIdentifier(),
+		Controller: r.Controller,
+		Sensors:    sensors,
+		Offline:    r.Offline,
+	})
+}
+
+// NewSinks return the sinks of the config, in the config order
+func NewSinks(config *utils.Config, cli *mqtt_client.Client) ([]Sink, error) {
+	sinks := make([]Sink, 0, len(config.Sinks))
+	names := map[string]bool{}
+	for i, sinkConfig := range config.Sinks {
+		sink, err := NewSink(config, sinkConfig, cli)
+		if err != nil {
+			return nil, fmt.Errorf("invalid sink #%d: %w", i+1, err)
+		}
+		if names[sink.Name()] {
+			return nil, fmt.Errorf("invalid sink #%d: duplicated name %q", i+1, sink.Name())
+		}
+		names[sink.Name()] = true
+		sinks = append(sinks, sink)
+	}
+	return sinks, nil
+}
+
+func NewSink(config *utils.Config, sinkConfig *utils.ConfigSink, cli *mqtt_client.Client) (Sink, error) {
+	name := sinkConfig.Name
+	if name == "" {
+		name = sinkConfig.Type
+	}
+	switch sinkConfig.Type {
+	case SINK_MQTT:
+		return NewMQTT(name, config, cli), nil
+	case SINK_FILE:
+		return NewFile(name, sinkConfig.Path)
+	case SINK_STDOUT:
+		return NewStdout(name), nil
+	case SINK_WEBHOOK:
+		return NewWebhook(name, sinkConfig)
+	}
+	return nil, fmt.Errorf("unknown type %q, expected %s, %s, %s or %s", sinkConfig.Type, SINK_MQTT, SINK_FILE, SINK_STDOUT, SINK_WEBHOOK)
+}
@@ -0,0 +1,36 @@
+package sink
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+)
+
+// Stdout write every record as a JSON line on the standard output, the logs are on the standard error
+type Stdout struct {
+	name string
+	mu   sync.Mutex
+}
+
+func NewStdout(name string) *Stdout {
+	return &Stdout{name: name}
+}
+
+func (s *Stdout) Name() string {
+	return s.name
+}
+
+func (s *Stdout) Publish(record *Record) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = os.Stdout.Write(append(line, '\n'))
+	return err
+}
+
+func (s *Stdout) Close() error {
+	return nil
+}
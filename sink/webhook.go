@@ -0,0 +1,78 @@
+package sink
+
+import (
+	"akwatek-mqtt-bridge/utils"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Webhook POST every record as JSON to an URL, an answer other than 2xx is an error
+type Webhook struct {
+	name    string
+	url     string
+	headers map[string]string
+	client  *http.Client
+}
+
+func NewWebhook(name string, sinkConfig *utils.ConfigSink) (*Webhook, error) {
+	parsedURL, err := url.Parse(sinkConfig.URL)
+	if err != nil {
+		return nil, err
+	}
+	if parsedURL.Scheme != "http" && parsedURL.Scheme != "https" {
+		return nil, fmt.Errorf("invalid webhook url %q, expected http or https", sinkConfig.URL)
+	}
+	timeout := sinkConfig.Timeout
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	return &Webhook{
+		name:    name,
+		url:     sinkConfig.URL,
+		headers: sinkConfig.Headers,
+		client:  &http.Client{Timeout: timeout},
+	}, nil
+}
+
+func (w *Webhook) Name() string {
+	return w.name
+}
+
+func (w *Webhook) Publish(record *Record) error {
+	body, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return w.Post(body)
+}
+
+// Post send a JSON body to the URL of the webhook
+func (w *Webhook) Post(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range w.headers {
+		req.Header.Set(key, value)
+	}
+	res, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, res.Body)
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("webhook %s answered %s", w.url, res.Status)
+	}
+	return nil
+}
+
+func (w *Webhook) Close() error {
+	return nil
+}
@@ -0,0 +1,68 @@
+package store
+
+import (
+	"akwatek-mqtt-bridge/models"
+	"encoding/json"
+	"go.etcd.io/bbolt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var controllersBucket = []byte("controllers")
+
+// BoltStore keep the controllers in an embedded key/value file
+type BoltStore struct {
+	db *bbolt.DB
+}
+
+func NewBoltStore(dataDir string) (*BoltStore, error) {
+	if err := os.MkdirAll(dataDir, 0o750); err != nil {
+		return nil, err
+	}
+	db, err := bbolt.Open(filepath.Join(dataDir, "akwatek-mqtt-bridge.db"), 0o600, &bbolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bbolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(controllersBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltStore{db: db}, nil
+}
+
+func (s *BoltStore) Load() ([]*models.AkwatekCtlSnapshot, error) {
+	snapshots := make([]*models.AkwatekCtlSnapshot, 0)
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(controllersBucket).ForEach(func(k, v []byte) error {
+			var snapshot models.AkwatekCtlSnapshot
+			if err := json.Unmarshal(v, &snapshot); err != nil {
+				return err
+			}
+			snapshots = append(snapshots, &snapshot)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return snapshots, nil
+}
+
+func (s *BoltStore) Save(identifier string, snapshot *models.AkwatekCtlSnapshot) error {
+	value, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(controllersBucket).Put([]byte(identifier), value)
+	})
+}
+
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,44 @@
+package store
+
+import (
+	"akwatek-mqtt-bridge/models"
+	"akwatek-mqtt-bridge/utils"
+	"fmt"
+)
+
+const (
+	STORE_BACKEND_BOLT string = "bolt"
+	STORE_BACKEND_NONE string = "none"
+)
+
+// Store persist the controllers state across bridge restarts
+type Store interface {
+	Load() ([]*models.AkwatekCtlSnapshot, error)
+	Save(identifier string, snapshot *models.AkwatekCtlSnapshot) error
+	Close() error
+}
+
+func NewStore(config *utils.Config) (Store, error) {
+	switch config.Store.Backend {
+	case STORE_BACKEND_BOLT:
+		return NewBoltStore(config.Store.DataDir)
+	case STORE_BACKEND_NONE:
+		return &NoopStore{}, nil
+	}
+	return nil, fmt.Errorf("unknown store backend %q", config.Store.Backend)
+}
+
+// NoopStore keep nothing, every restart forget the controllers
+type NoopStore struct{}
+
+func (s *NoopStore) Load() ([]*models.AkwatekCtlSnapshot, error) {
+	return nil, nil
+}
+
+func (s *NoopStore) Save(identifier string, snapshot *models.AkwatekCtlSnapshot) error {
+	return nil
+}
+
+func (s *NoopStore) Close() error {
+	return nil
+}
@@ -1,25 +1,171 @@
 package utils
 
 import (
+	"bytes"
+	"fmt"
+	"github.com/mitchellh/mapstructure"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/viper"
+	"net"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	MQTT_VERSION_3           string = "3"
+	MQTT_VERSION_5           string = "5"
+	VALVE_INTERLOCK_OFF      string = "off"
+	VALVE_INTERLOCK_REJECT   string = "reject"
+	VALVE_INTERLOCK_OVERRIDE string = "override"
+	HASS_DISCOVERY_ENTITY    string = "entity"
+	HASS_DISCOVERY_DEVICE    string = "device"
 )
 
 type Config struct {
-	TLSPort            int
-	MQTT               *ConfigMQTT
-	HassDiscoveryTopic string
-	LogLevel           zerolog.Level
+	TLSPort               int
+	MQTT                  *ConfigMQTT
+	HassDiscoveryEnabled  bool
+	HassDiscoveryTopic    string
+	HassDiscoveryMode     string
+	HassDiscoveryMigrate  bool
+	HassConfigurationURL  string
+	HassSensorDevices     bool
+	HomieEnabled          bool
+	HomieBaseTopic        string
+	LogLevel              zerolog.Level
+	Passthrough           *ConfigPassthrough
+	Store                 *ConfigStore
+	CaptureFile           string
+	CheckInInterval       time.Duration
+	OfflineMissedCheckIns int
+	SensorRemovalGrace    time.Duration
+	ValveCommand          *ConfigValveCommand
+	Policies              []*ConfigPolicy
+	Schedules             []*ConfigSchedule
+	DryRun                bool
+	Controllers           []*ConfigController
+	Sinks                 []*ConfigSink
+	Notifications         []*ConfigNotification
 }
 
 type ConfigMQTT struct {
+	BrokerURL  string
 	BrokerHost string
 	BrokerPort int
 	ClientID   string
 	BaseTopic  string
 	Username   string
 	Password   string
+	Version    string
+	// message expiry of the states, only with MQTT v5
+	StateExpiry time.Duration
+	// TLS of ssl, mqtts and wss brokers
+	CAFile             string
+	ClientCertFile     string
+	ClientKeyFile      string
+	InsecureSkipVerify bool
+	ALPN               []string
+	// QoS and retain flag of each category of publication
+	Discovery    *ConfigMQTTPublish
+	State        *ConfigMQTTPublish
+	LeakState    *ConfigMQTTPublish
+	Availability *ConfigMQTTPublish
+	Events       *ConfigMQTTPublish
+	ValveResult  *ConfigMQTTPublish
+	CommandQoS   byte
+}
+
+type ConfigValveCommand struct {
+	ConfirmCheckIns int
+	MaxAttempts     int
+	Interlock       string
+	OverrideTTL     time.Duration
+}
+
+// ConfigController is the settings of a controller, only in the config file
+type ConfigController struct {
+	MAC    string        `mapstructure:"mac"`
+	Name   string        `mapstructure:"name"`
+	Area   string        `mapstructure:"area"`
+	DryRun *bool         `mapstructure:"dry_run"`
+	Zones  []*ConfigZone `mapstructure:"zones"`
+	mac    net.HardwareAddr
+}
+
+// ConfigZone is the friendly name and the Home Assistant area of the sensor of a zone,
+// an ignored zone isn't published
+type ConfigZone struct {
+	ID     int    `mapstructure:"id"`
+	Name   string `mapstructure:"name"`
+	Area   string `mapstructure:"area"`
+	Ignore bool   `mapstructure:"ignore"`
+}
+
+// ConfigSink is an output of the decoded check-ins, only in the config file,
+// Path is the file of a file sink, URL, Timeout and Headers are the request of a webhook sink
+type ConfigSink struct {
+	Name    string            `mapstructure:"name"`
+	Type    string            `mapstructure:"type"`
+	Path    string            `mapstructure:"path"`
+	URL     string            `mapstructure:"url"`
+	Timeout time.Duration     `mapstructure:"timeout"`
+	Headers map[string]string `mapstructure:"headers"`
+}
+
+// ConfigNotification is an outgoing webhook of the events, only in the config file,
+// Body is a template of the JSON body given the event, Events are the types sent, all of them if empty,
+// a failed delivery is retried after Backoff, doubled on every attempt up to MaxBackoff
+type ConfigNotification struct {
+	Name        string            `mapstructure:"name"`
+	URL         string            `mapstructure:"url"`
+	Timeout     time.Duration     `mapstructure:"timeout"`
+	Headers     map[string]string `mapstructure:"headers"`
+	Body        string            `mapstructure:"body"`
+	Events      []string          `mapstructure:"events"`
+	MaxAttempts int               `mapstructure:"max_attempts"`
+	Backoff     time.Duration     `mapstructure:"backoff"`
+	MaxBackoff  time.Duration     `mapstructure:"max_backoff"`
+}
+
+// ConfigPolicy is an automatic valve shut-off rule, only in the config file
+type ConfigPolicy struct {
+	Name       string        `mapstructure:"name"`
+	Type       string        `mapstructure:"type"`
+	Zones      []int         `mapstructure:"zones"`
+	MinSensors int           `mapstructure:"min_sensors"`
+	Duration   time.Duration `mapstructure:"duration"`
+}
+
+// ConfigSchedule is a scheduled valve action, only in the config file
+type ConfigSchedule struct {
+	Name                string    `mapstructure:"name"`
+	Type                string    `mapstructure:"type"`
+	Cron                string    `mapstructure:"cron"`
+	ReopenAfterCheckIns int       `mapstructure:"reopen_after_checkins"`
+	Start               time.Time `mapstructure:"start"`
+	End                 time.Time `mapstructure:"end"`
+	Controllers         []string  `mapstructure:"controllers"`
+}
+
+type ConfigMQTTPublish struct {
+	QoS    byte
+	Retain bool
+}
+
+type ConfigStore struct {
+	Backend string
+	DataDir string
+}
+
+type ConfigPassthrough struct {
+	Enabled            bool
+	URL                string
+	ValvePriority      string
+	Timeout            time.Duration
+	InsecureSkipVerify bool
 }
 
 func GetConfig() *Config {
@@ -35,27 +181,238 @@ func GetConfig() *Config {
 	viper.SetDefault("LOG_LEVEL", "info")
 	viper.SetDefault("TLS_PORT", 443) // The controler is hardcoded to use this port
 	viper.SetDefault("MQTT_BROKER_PORT", 1883)
+	viper.SetDefault("MQTT_INSECURE_SKIP_VERIFY", false)
 	viper.SetDefault("MQTT_CLIENT_ID", "akwatek")
 	viper.SetDefault("MQTT_BASE_TOPIC", "akwatek")
+	viper.SetDefault("HASS_DISCOVERY", true)
 	viper.SetDefault("HASS_DISCOVERY_TOPIC", "homeassistant")
+	viper.SetDefault("HASS_DISCOVERY_MODE", "entity") // entity or device
+	viper.SetDefault("HASS_DISCOVERY_MIGRATE", false)
+	viper.SetDefault("HASS_CONFIGURATION_URL", "")
+	viper.SetDefault("HASS_SENSOR_DEVICES", false)
+	viper.SetDefault("HOMIE", false)
+	viper.SetDefault("HOMIE_BASE_TOPIC", "homie")
+	viper.SetDefault("MQTT_DISCOVERY_QOS", 1)
+	viper.SetDefault("MQTT_DISCOVERY_RETAIN", true)
+	viper.SetDefault("MQTT_STATE_QOS", 0)
+	viper.SetDefault("MQTT_STATE_RETAIN", false)
+	viper.SetDefault("MQTT_LEAK_STATE_QOS", 1)
+	viper.SetDefault("MQTT_LEAK_STATE_RETAIN", true)
+	viper.SetDefault("MQTT_AVAILABILITY_QOS", 1)
+	viper.SetDefault("MQTT_AVAILABILITY_RETAIN", true)
+	viper.SetDefault("MQTT_EVENTS_QOS", 1)
+	viper.SetDefault("MQTT_EVENTS_RETAIN", false)
+	viper.SetDefault("MQTT_VALVE_RESULT_QOS", 1)
+	viper.SetDefault("MQTT_VALVE_RESULT_RETAIN", false)
+	viper.SetDefault("MQTT_COMMAND_QOS", 1)
+	viper.SetDefault("MQTT_VERSION", "3") // 3 or 5
+	viper.SetDefault("MQTT_STATE_EXPIRY", "0s")
+	viper.SetDefault("PASSTHROUGH_ENABLED", false)
+	viper.SetDefault("PASSTHROUGH_URL", "https://app.akwatek.com/collect2.php")
+	viper.SetDefault("PASSTHROUGH_VALVE_PRIORITY", "mqtt") // mqtt or cloud
+	viper.SetDefault("PASSTHROUGH_TIMEOUT", "5s")
+	viper.SetDefault("PASSTHROUGH_INSECURE_SKIP_VERIFY", false)
+	viper.SetDefault("STORE_BACKEND", "bolt") // bolt or none
+	viper.SetDefault("DATA_DIR", "data")
+	viper.SetDefault("CHECKIN_INTERVAL", "1m")
+	viper.SetDefault("OFFLINE_MISSED_CHECKINS", 3)
+	viper.SetDefault("SENSOR_REMOVAL_GRACE", "1h")
+	viper.SetDefault("VALVE_COMMAND_CONFIRM_CHECKINS", 2)
+	viper.SetDefault("VALVE_COMMAND_MAX_ATTEMPTS", 3)
+	viper.SetDefault("VALVE_INTERLOCK", "off") // off, reject or override
+	viper.SetDefault("DRY_RUN", false)
+	viper.SetDefault("VALVE_INTERLOCK_OVERRIDE_TTL", "5m")
 
 	logLevel, err := zerolog.ParseLevel(viper.GetString("LOG_LEVEL"))
 	if err != nil {
 		log.Fatal().Err(err).Msg("failed to parse log level")
 	}
 
+	valvePriority := viper.GetString("PASSTHROUGH_VALVE_PRIORITY")
+	if valvePriority != "mqtt" && valvePriority != "cloud" {
+		log.Fatal().Msgf("invalid passthrough valve priority %q, expected mqtt or cloud", valvePriority)
+	}
+
+	interlock := viper.GetString("VALVE_INTERLOCK")
+	if !slices.Contains([]string{VALVE_INTERLOCK_OFF, VALVE_INTERLOCK_REJECT, VALVE_INTERLOCK_OVERRIDE}, interlock) {
+		log.Fatal().Msgf("invalid valve interlock %q, expected off, reject or override", interlock)
+	}
+
+	hassDiscoveryMode := viper.GetString("HASS_DISCOVERY_MODE")
+	if hassDiscoveryMode != HASS_DISCOVERY_ENTITY && hassDiscoveryMode != HASS_DISCOVERY_DEVICE {
+		log.Fatal().Msgf("invalid Home Assistant discovery mode %q, expected entity or device", hassDiscoveryMode)
+	}
+
+	mqttVersion := viper.GetString("MQTT_VERSION")
+	if mqttVersion != MQTT_VERSION_3 && mqttVersion != MQTT_VERSION_5 {
+		log.Fatal().Msgf("invalid MQTT version %q, expected 3 or 5", mqttVersion)
+	}
+
+	brokerURL := viper.GetString("MQTT_BROKER_URL")
+	if brokerURL == "" {
+		brokerURL = fmt.Sprintf("tcp://%s:%d", viper.GetString("MQTT_BROKER_HOST"), viper.GetInt("MQTT_BROKER_PORT"))
+	}
+	if parsedURL, err := url.Parse(brokerURL); err != nil {
+		log.Fatal().Err(err).Msgf("invalid MQTT broker url %s", brokerURL)
+	} else if !slices.Contains([]string{"tcp", "ssl", "mqtts", "ws", "wss"}, parsedURL.Scheme) {
+		log.Fatal().Msgf("invalid MQTT broker url %s, expected tcp, ssl, mqtts, ws or wss scheme", brokerURL)
+	}
+
+	alpn := make([]string, 0)
+	for _, protocol := range strings.Split(viper.GetString("MQTT_ALPN"), ",") {
+		if protocol = strings.TrimSpace(protocol); protocol != "" {
+			alpn = append(alpn, protocol)
+		}
+	}
+
+	policies := make([]*ConfigPolicy, 0)
+	if err := viper.UnmarshalKey("policies", &policies); err != nil {
+		log.Fatal().Err(err).Msg("failed to parse policies")
+	}
+
+	schedules := make([]*ConfigSchedule, 0)
+	if err := viper.UnmarshalKey("schedules", &schedules, viper.DecodeHook(mapstructure.ComposeDecodeHookFunc(
+		mapstructure.StringToTimeHookFunc(time.RFC3339),
+		mapstructure.StringToTimeDurationHookFunc(),
+	))); err != nil {
+		log.Fatal().Err(err).Msg("failed to parse schedules")
+	}
+
+	// the MQTT state is the only output if no sink is configured
+	sinks := []*ConfigSink{{Type: "mqtt"}}
+	if viper.IsSet("sinks") {
+		sinks = make([]*ConfigSink, 0)
+		if err := viper.UnmarshalKey("sinks", &sinks); err != nil {
+			log.Fatal().Err(err).Msg("failed to parse sinks")
+		}
+	}
+	// the discovery point Home Assistant to the availability and state topics of the mqtt sink
+	if viper.GetBool("HASS_DISCOVERY") && !slices.ContainsFunc(sinks, func(sink *ConfigSink) bool { return sink.Type == "mqtt" }) {
+		log.Fatal().Msg("Home Assistant discovery requires a mqtt sink, add one or set AMB_HASS_DISCOVERY to false")
+	}
+
+	notifications := make([]*ConfigNotification, 0)
+	if err := viper.UnmarshalKey("notifications", &notifications); err != nil {
+		log.Fatal().Err(err).Msg("failed to parse notifications")
+	}
+
+	controllers := make([]*ConfigController, 0)
+	if err := viper.UnmarshalKey("controllers", &controllers); err != nil {
+		log.Fatal().Err(err).Msg("failed to parse controllers")
+	}
+	for _, controller := range controllers {
+		if controller.mac, err = net.ParseMAC(controller.MAC); err != nil {
+			log.Fatal().Err(err).Msgf("invalid controller MAC address %q", controller.MAC)
+		}
+		zones := map[int]bool{}
+		for _, zone := range controller.Zones {
+			if zone.ID < 1 || zone.ID > 100 {
+				log.Fatal().Msgf("invalid zone %d of controller %s, expected 1 to 100", zone.ID, controller.MAC)
+			}
+			if zones[zone.ID] {
+				log.Fatal().Msgf("duplicated zone %d of controller %s", zone.ID, controller.MAC)
+			}
+			zones[zone.ID] = true
+		}
+	}
+
 	config := Config{
 		LogLevel: logLevel,
 		TLSPort:  viper.GetInt("TLS_PORT"),
 		MQTT: &ConfigMQTT{
+			BrokerURL:  brokerURL,
 			BrokerHost: viper.GetString("MQTT_BROKER_HOST"),
 			BrokerPort: viper.GetInt("MQTT_BROKER_PORT"),
 			ClientID:   viper.GetString("MQTT_CLIENT_ID"),
 			BaseTopic:  viper.GetString("MQTT_BASE_TOPIC"),
 			Username:   viper.GetString("MQTT_USERNAME"),
 			Password:   viper.GetString("MQTT_PASSWORD"),
+			Version:    mqttVersion,
+
+			StateExpiry: viper.GetDuration("MQTT_STATE_EXPIRY"),
+
+			CAFile:             viper.GetString("MQTT_CA_FILE"),
+			ClientCertFile:     viper.GetString("MQTT_CLIENT_CERT_FILE"),
+			ClientKeyFile:      viper.GetString("MQTT_CLIENT_KEY_FILE"),
+			InsecureSkipVerify: viper.GetBool("MQTT_INSECURE_SKIP_VERIFY"),
+			ALPN:               alpn,
+
+			Discovery:    getConfigMQTTPublish("DISCOVERY"),
+			State:        getConfigMQTTPublish("STATE"),
+			LeakState:    getConfigMQTTPublish("LEAK_STATE"),
+			Availability: getConfigMQTTPublish("AVAILABILITY"),
+			Events:       getConfigMQTTPublish("EVENTS"),
+			ValveResult:  getConfigMQTTPublish("VALVE_RESULT"),
+			CommandQoS:   getQoS("MQTT_COMMAND_QOS"),
+		},
+		HassDiscoveryEnabled: viper.GetBool("HASS_DISCOVERY"),
+		HassDiscoveryTopic:   viper.GetString("HASS_DISCOVERY_TOPIC"),
+		HassDiscoveryMode:    hassDiscoveryMode,
+		HassDiscoveryMigrate: viper.GetBool("HASS_DISCOVERY_MIGRATE"),
+		HassConfigurationURL: viper.GetString("HASS_CONFIGURATION_URL"),
+		HassSensorDevices:    viper.GetBool("HASS_SENSOR_DEVICES"),
+		HomieEnabled:         viper.GetBool("HOMIE"),
+		HomieBaseTopic:       viper.GetString("HOMIE_BASE_TOPIC"),
+		Passthrough: &ConfigPassthrough{
+			Enabled:            viper.GetBool("PASSTHROUGH_ENABLED"),
+			URL:                viper.GetString("PASSTHROUGH_URL"),
+			ValvePriority:      valvePriority,
+			Timeout:            viper.GetDuration("PASSTHROUGH_TIMEOUT"),
+			InsecureSkipVerify: viper.GetBool("PASSTHROUGH_INSECURE_SKIP_VERIFY"),
+		},
+		Store: &ConfigStore{
+			Backend: viper.GetString("STORE_BACKEND"),
+			DataDir: viper.GetString("DATA_DIR"),
+		},
+		CaptureFile:           viper.GetString("CAPTURE_FILE"),
+		CheckInInterval:       viper.GetDuration("CHECKIN_INTERVAL"),
+		OfflineMissedCheckIns: viper.GetInt("OFFLINE_MISSED_CHECKINS"),
+		SensorRemovalGrace:    viper.GetDuration("SENSOR_REMOVAL_GRACE"),
+		ValveCommand: &ConfigValveCommand{
+			ConfirmCheckIns: viper.GetInt("VALVE_COMMAND_CONFIRM_CHECKINS"),
+			MaxAttempts:     viper.GetInt("VALVE_COMMAND_MAX_ATTEMPTS"),
+			Interlock:       interlock,
+			OverrideTTL:     viper.GetDuration("VALVE_INTERLOCK_OVERRIDE_TTL"),
 		},
-		HassDiscoveryTopic: viper.GetString("HASS_DISCOVERY_TOPIC"),
+		Policies:      policies,
+		Schedules:     schedules,
+		DryRun:        viper.GetBool("DRY_RUN"),
+		Controllers:   controllers,
+		Sinks:         sinks,
+		Notifications: notifications,
 	}
 	return &config
 }
+
+// GetController return the settings of a controller, nil if it has none
+func (c *Config) GetController(mac net.HardwareAddr) *ConfigController {
+	for _, controller := range c.Controllers {
+		if bytes.Equal(controller.mac, mac) {
+			return controller
+		}
+	}
+	return nil
+}
+
+// IsDryRun return the dry-run of the controller, the global one if it isn't set
+func (c *Config) IsDryRun(mac net.HardwareAddr) bool {
+	if controller := c.GetController(mac); controller != nil && controller.DryRun != nil {
+		return *controller.DryRun
+	}
+	return c.DryRun
+}
+
+func getQoS(key string) byte {
+	qos := viper.GetInt(key)
+	if qos < 0 || qos > 2 {
+		log.Fatal().Msgf("invalid %s %d, expected 0, 1 or 2", key, qos)
+	}
+	return byte(qos)
+}
+
+func getConfigMQTTPublish(category string) *ConfigMQTTPublish {
+	return &ConfigMQTTPublish{
+		QoS:    getQoS(fmt.Sprintf("MQTT_%s_QOS", category)),
+		Retain: viper.GetBool(fmt.Sprintf("MQTT_%s_RETAIN", category)),
+	}
+}
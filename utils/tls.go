@@ -8,9 +8,11 @@ import (
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/pem"
+	"fmt"
 	"github.com/rs/zerolog/log"
 	"math/big"
 	"net"
+	"os"
 	"time"
 )
 
@@ -120,3 +122,33 @@ func CertSetup() (serverTLSConf *tls.Config, clientTLSConf *tls.Config, err erro
 
 	return
 }
+
+// MQTTTLSConfig build the TLS config of the connection to the MQTT broker
+func MQTTTLSConfig(config *ConfigMQTT) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: config.InsecureSkipVerify,
+		NextProtos:         config.ALPN,
+	}
+
+	if config.CAFile != "" {
+		caPEM, err := os.ReadFile(config.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		certpool := x509.NewCertPool()
+		if !certpool.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("no certificate found in %s", config.CAFile)
+		}
+		tlsConfig.RootCAs = certpool
+	}
+
+	if config.ClientCertFile != "" || config.ClientKeyFile != "" {
+		clientCert, err := tls.LoadX509KeyPair(config.ClientCertFile, config.ClientKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{clientCert}
+	}
+
+	return tlsConfig, nil
+}